@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	chowder "github.com/lachlanmunro/chowder/pkg"
+)
+
+// auditCommand runs the audit subcommands, returning the process exit code
+func auditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: chowder audit verify <oldest file> ... <newest file>")
+		return 2
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	genesis := fs.Bool("genesis", false, "Require the first record to start a new chain rather than continue a rotated away file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: chowder audit verify [flags] <oldest file> ... <newest file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	v := &chowder.AuditVerifier{}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			return 2
+		}
+		err = v.Verify(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			return 1
+		}
+	}
+	if v.First == nil {
+		fmt.Println("no audit records found")
+		return 0
+	}
+	if *genesis && v.First.Previous != "" {
+		fmt.Fprintf(os.Stderr, "first record (seq %v) continues an earlier chain ending %v\n", v.First.Sequence, v.First.Previous)
+		return 1
+	}
+	fmt.Printf("verified %v records from seq %v\n", v.Records, v.First.Sequence)
+	return 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	chowder "github.com/lachlanmunro/chowder/pkg"
+	"github.com/rs/zerolog"
+)
+
+// loadConfig completes the parsed flags from CHOWDER_* environment variables and the -config file, then
+// checks the settings make sense together
+func loadConfig() error {
+	if err := chowder.LoadConfig(flag.CommandLine, "config", "CHOWDER_", os.LookupEnv); err != nil {
+		return err
+	}
+	return validateConfig()
+}
+
+// validateConfig reports every setting that parses but cannot be used
+func validateConfig() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	_, err := zerolog.ParseLevel(*level)
+	check(err == nil, "level must be one of debug, info, warn, error, fatal, panic")
+	clientAuthType, err := chowder.ParseClientAuth(*clientAuth)
+	check(err == nil, "clientauth %v", err)
+	check(clientAuthType == tls.NoClientCert || *clientCAFile != "", "clientauth %v requires a clientca bundle", *clientAuth)
+	mode, err := chowder.ParseTLSMode(*tlsMode)
+	check(err == nil, "%v", err)
+	check(mode != chowder.TLSOff || clientAuthType == tls.NoClientCert, "clientauth %v requires tls, not tls off", *clientAuth)
+	if mode == chowder.TLSRequired {
+		_, err = mode.UseFiles(*certFile, *keyFile)
+		check(err == nil, "%v", err)
+	}
+	_, err = chowder.ParseTLSVersion(*tlsMinVersion)
+	check(err == nil, "tlsminversion %v", err)
+	_, err = chowder.ParseCipherSuites(*tlsCiphers)
+	check(err == nil, "tlsciphers %v", err)
+	check(*tlsReload >= 0, "tlsreload must not be negative")
+	var high, normal, low int
+	_, err = fmt.Sscanf(*priorityWeights, "%d,%d,%d", &high, &normal, &low)
+	check(err == nil, "priorityweights must be three comma separated integers")
+	for _, r := range strings.Split(*priorityRoles, ",") {
+		check(r == chowder.RoleScanner || r == chowder.RoleReader || r == chowder.RoleAdmin, "priorityroles has unknown role '%v'", r)
+	}
+	check(*scanSlots >= 0, "scanslots must not be negative")
+	check(*scanQueue >= 0, "scanqueue must not be negative")
+	check(*maxConcurrent >= 0, "maxconcurrent must not be negative")
+	check(*icapMaxEcho > 0, "icapmaxecho must be positive")
+	check(*batchConcurrency > 0 && *batchEntrySize > 0, "batchconcurrency and batchentrysize must be positive")
+	_, err = chowder.NewURLFetcher(*urlSchemes, *urlHosts, *urlNetworks, *urlMaxSize, *urlTimeout, *urlRedirects)
+	check(err == nil, "urlnetworks %v", err)
+	check(*urlMaxSize > 0 && *urlTimeout > 0, "urlmaxsize and urltimeout must be positive")
+	check(*urlRedirects >= 0, "urlredirects must not be negative")
+	if *s3Endpoint != "" {
+		_, err = chowder.NewS3Client(*s3Endpoint, *s3Region, *s3AccessKey, *s3SecretKey)
+		check(err == nil, "%v", err)
+		check(*s3AccessKey != "" && *s3SecretKey != "", "s3endpoint requires s3accesskey and s3secretkey")
+		for _, b := range strings.Split(*s3Buckets, ",") {
+			check(*s3Quarantine == "" || strings.TrimSpace(b) != *s3Quarantine, "s3quarantine must not be one of the s3buckets scanned")
+		}
+	}
+	check(*auditSize >= 0, "auditsize must not be negative")
+	check(*auditKeep >= 0, "auditkeep must not be negative")
+	check(*usageFlush > 0, "usageflush must be positive")
+	check(*healthInterval > 0, "healthinterval must be positive")
+	check(*usersReload >= 0, "usersreload must not be negative")
+	check(*jwksRefresh >= 0, "jwksrefresh must not be negative")
+	check(*drainDelay >= 0 && *shutdownTimeout >= 0, "draindelay and shutdowntimeout must not be negative")
+	for _, v := range []float64{*rateLimit, *rateBurst, *byteLimit, *byteBurst} {
+		check(v >= 0, "ratelimit, rateburst, bytelimit and byteburst must not be negative")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// configCommand runs the config subcommands, returning the process exit code
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: chowder config print [flags]")
+		return 2
+	}
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: chowder config print [flags]")
+		fmt.Fprintln(flag.CommandLine.Output(), "Prints the effective configuration from the flags, CHOWDER_* environment and -config file as a config file, leaving out the -clamdtoken and -s3secretkey secrets")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args[1:])
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := chowder.WriteConfig(os.Stdout, flag.CommandLine, "config", "clamdtoken", "s3secretkey"); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write config: %v\n", err)
+		return 1
+	}
+	return 0
+}
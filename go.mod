@@ -7,6 +7,9 @@ require (
 	github.com/prometheus/client_golang v1.13.0
 	github.com/prometheus/client_model v0.3.0
 	github.com/rs/zerolog v1.32.0
-	github.com/stretchr/testify v1.8.2
+	github.com/stretchr/testify v1.8.3
+	golang.org/x/crypto v0.12.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"html/template"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -12,20 +20,106 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
-	level := flag.String("level", "info", "Log level is one of debug, info, warn, error, fatal, panic")
-	bind := flag.String("bind", ":3399", "Binding URL")
-	antivirusURL := flag.String("antivirus", "127.0.0.1:3310", "Destination antivirus URL")
-	certFile := flag.String("certfile", "server.crt", "Server TLS certificate")
-	keyFile := flag.String("keyfile", "server.key", "Server TLS key")
-	pretty := flag.Bool("pretty", false, "Use pretty logging (instead of JSON)")
-	usersFile := flag.String("usersfile", "users.yml", "Users file containing auth tokens in the format `token: username\\n`, if not supplied or empty authentication will be disabled")
-	unixTime := flag.Bool("unixtime", false, "Log unix timestamps instead of RFC3339Nano")
-	floatDurations := flag.Bool("floatdur", false, "Log float durations instead of integers")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "audit":
+			os.Exit(auditCommand(os.Args[2:]))
+		case "users":
+			os.Exit(usersCommand(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		case "scan":
+			os.Exit(scanCommand(os.Args[2:]))
+		}
+	}
+	serve()
+}
+
+// Settings are flags, which may also be supplied by environment variables or a config file (see loadConfig)
+var (
+	configFile       = flag.String("config", "", "Yaml file of settings named as these flags (see chowder config print), overridden by CHOWDER_<FLAG> environment variables and then by flags")
+	level            = flag.String("level", "info", "Log level is one of debug, info, warn, error, fatal, panic")
+	bind             = flag.String("bind", ":3399", "Binding URL")
+	antivirusURL     = flag.String("antivirus", "127.0.0.1:3310", "Destination antivirus URL")
+	tlsMode          = flag.String("tls", "auto", "TLS mode, one of off (plaintext), required (refuse to start without certfile and keyfile), auto (tls when both exist, plaintext when neither does) or selfsigned (an ephemeral certificate for development)")
+	certFile         = flag.String("certfile", "server.crt", "Server TLS certificate")
+	keyFile          = flag.String("keyfile", "server.key", "Server TLS key")
+	tlsReload        = flag.Duration("tlsreload", time.Minute, "How often to check the certfile and keyfile for a renewed key pair, 0 disables reloading")
+	tlsMinVersion    = flag.String("tlsminversion", "1.2", "Minimum TLS version, one of 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers       = flag.String("tlsciphers", "", "Comma separated TLS 1.0-1.2 cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), Go's defaults if empty")
+	tlsALPN          = flag.String("tlsalpn", "h2,http/1.1", "Comma separated ALPN protocols offered, leave out h2 to disable HTTP/2")
+	grpcBind         = flag.String("grpcbind", "", "Address to serve the gRPC Scanner and health services on (e.g. :3398), with the same tls as the http api, disabled if empty")
+	clamdBind        = flag.String("clamdbind", "", "Address to serve the clamd protocol (PING, VERSION, INSTREAM, IDSESSION) on for tools written for clamd (e.g. :3310), disabled if empty")
+	clamdToken       = flag.String("clamdtoken", "", "Token clamd protocol scans authenticate with, as clamd clients cannot send one")
+	icapBind         = flag.String("icapbind", "", "Address to serve ICAP (RFC 3507) REQMOD and RESPMOD scans on (e.g. :1344), disabled if empty")
+	icapBlockPage    = flag.String("icapblockpage", "", "Html template file served to ICAP clients in place of infected content, given .Signature and .URL, a built in page if empty")
+	icapMaxEcho      = flag.Int64("icapmaxecho", chowder.DefaultICAPEchoSize, "Largest content in bytes sent back to ICAP clients that do not allow 204, larger content is answered with an error")
+	clientAuth       = flag.String("clientauth", "none", "Client certificate authentication, one of none, verify (if presented) or require")
+	clientCAFile     = flag.String("clientca", "", "PEM bundle of CAs trusted to issue client certificates")
+	clientMapFile    = flag.String("clientmap", "", "Yaml file mapping client certificate SAN or common name to `{user: name, roles: [...]}`, if empty the certificate name is the user")
+	pretty           = flag.Bool("pretty", false, "Use pretty logging (instead of JSON)")
+	usersFile        = flag.String("usersfile", "users.yml", "Users file containing auth tokens in the format `token: username\\n` or `token: {user: username, roles: [scanner, reader, admin]}\\n`, if not supplied or empty authentication will be disabled")
+	authHeader       = flag.String("authheader", "", "Additional header that may carry an API key token (e.g. X-API-Key), disabled if empty")
+	rawTokens        = flag.Bool("rawtokens", true, "Accept bare tokens in the Authorization header as well as `Bearer <token>`, for older clients")
+	jwksLocation     = flag.String("jwks", "", "JWKS file or URL used to validate JWT bearer tokens, JWT authentication is disabled if empty")
+	jwksRefresh      = flag.Duration("jwksrefresh", time.Hour, "How often to reload the JWKS, 0 only reloads for unknown key ids")
+	jwtIssuer        = flag.String("jwtissuer", "", "Required JWT iss claim, not checked if empty")
+	jwtAudience      = flag.String("jwtaudience", "", "Required JWT aud claim value, not checked if empty")
+	jwtUserClaim     = flag.String("jwtuserclaim", "sub", "JWT claim used as the username")
+	jwtRolePrefix    = flag.String("jwtroleprefix", chowder.DefaultRoleScopePrefix, "Prefix of the JWT scopes granting roles (e.g. `chowder:scanner`), tokens without one get scanner and reader")
+	rateLimit        = flag.Float64("ratelimit", 0, "Default per user scan requests per second, 0 is unlimited")
+	rateBurst        = flag.Float64("rateburst", 0, "Default per user burst of scan requests, defaults to the rate")
+	byteLimit        = flag.Float64("bytelimit", 0, "Default per user scanned bytes per second, 0 is unlimited")
+	byteBurst        = flag.Float64("byteburst", 0, "Default per user burst of scanned bytes, defaults to the byte rate")
+	maxConcurrent    = flag.Int("maxconcurrent", 0, "Default per user concurrent scans, 0 is unlimited")
+	usageFile        = flag.String("usagefile", "", "Json file persisting per user scan counts and bytes, kept in memory only if empty")
+	usageFlush       = flag.Duration("usageflush", time.Minute, "How often usage counters are written to the usage file")
+	dailyBytes       = flag.Int64("dailybytes", 0, "Default per user daily (UTC) quota of scanned bytes, 0 is unlimited")
+	dailyScans       = flag.Int64("dailyscans", 0, "Default per user daily (UTC) quota of scans, 0 is unlimited")
+	monthlyBytes     = flag.Int64("monthlybytes", 0, "Default per user monthly (UTC) quota of scanned bytes, 0 is unlimited")
+	monthlyScans     = flag.Int64("monthlyscans", 0, "Default per user monthly (UTC) quota of scans, 0 is unlimited")
+	scanSlots        = flag.Int("scanslots", 0, "Maximum concurrent scans sent to the antivirus (match clamd MaxThreads), 0 is unlimited")
+	scanQueue        = flag.Int("scanqueue", 100, "Maximum scans waiting for one of the scanslots before answering 503")
+	scanQueueTimeout = flag.Duration("scanqueuetimeout", 30*time.Second, "Maximum time a scan waits for one of the scanslots before answering 503")
+	priorityHeader   = flag.String("priorityheader", "X-Chowder-Priority", "Header that may set a scan's priority (high, normal or low), disabled if empty")
+	priorityRoles    = flag.String("priorityroles", chowder.RoleAdmin, "Comma separated roles allowed to use the priorityheader")
+	priorityWeights  = flag.String("priorityweights", "6,3,1", "Comma separated share of freed scanslots given to high, normal and low priority scans")
+	batchConcurrency = flag.Int("batchconcurrency", chowder.DefaultBatchConcurrency, "Entries of a POST /scan/batch scanned at once")
+	batchEntrySize   = flag.Int64("batchentrysize", chowder.DefaultBatchEntrySize, "Largest entry of a POST /scan/batch in bytes, as entries are held in memory to be scanned")
+	urlHosts         = flag.String("urlhosts", "", "Comma separated hosts POST /scan/url may fetch from (e.g. artifacts.internal,*.example.com or * for any), disabled if empty")
+	urlSchemes       = flag.String("urlschemes", "https", "Comma separated url schemes POST /scan/url may fetch")
+	urlNetworks      = flag.String("urlnetworks", "", "Comma separated private or otherwise reserved networks POST /scan/url may connect to (e.g. 10.1.0.0/16), none if empty")
+	urlMaxSize       = flag.Int64("urlmaxsize", chowder.DefaultFetchSize, "Largest content POST /scan/url fetches in bytes")
+	urlTimeout       = flag.Duration("urltimeout", chowder.DefaultFetchTimeout, "Maximum time POST /scan/url takes to fetch and scan")
+	urlRedirects     = flag.Int("urlredirects", 3, "Maximum redirects POST /scan/url follows")
+	s3Endpoint       = flag.String("s3endpoint", "", "S3 compatible object storage (e.g. http://minio:9000) POST /scan/s3 and bucket notifications to POST /s3/events scan objects in, disabled if empty")
+	s3Region         = flag.String("s3region", "us-east-1", "Region requests to -s3endpoint are signed for")
+	s3AccessKey      = flag.String("s3accesskey", "", "Access key for -s3endpoint")
+	s3SecretKey      = flag.String("s3secretkey", "", "Secret key for -s3endpoint, better set by CHOWDER_S3SECRETKEY")
+	s3Buckets        = flag.String("s3buckets", "", "Comma separated buckets whose objects may be scanned, any if empty")
+	s3Quarantine     = flag.String("s3quarantine", "", "Bucket infected objects are moved to, none (only tagged) if empty")
+	usersReload      = flag.Duration("usersreload", 10*time.Second, "How often to check the users file for changes, 0 disables polling (SIGHUP always reloads)")
+	unixTime         = flag.Bool("unixtime", false, "Log unix timestamps instead of RFC3339Nano")
+	floatDurations   = flag.Bool("floatdur", false, "Log float durations instead of integers")
+	auditFile        = flag.String("auditfile", "", "Append a hash chained audit trail of scan decisions and admin actions to this file, disabled if empty")
+	auditSize        = flag.Int64("auditsize", 100, "Rotate the audit file once it exceeds this many megabytes, 0 disables rotation")
+	auditKeep        = flag.Int("auditkeep", 10, "Number of rotated audit files to keep")
+	healthInterval   = flag.Duration("healthinterval", 5*time.Second, "How often the antivirus is pinged in the background for /readyz and /healthz")
+	drainDelay       = flag.Duration("draindelay", 5*time.Second, "On SIGTERM or SIGINT, how long to fail health checks before closing the listener so load balancers can stop sending scans")
+	shutdownTimeout  = flag.Duration("shutdowntimeout", 30*time.Second, "How long in flight scans may take to finish after the listener closes before connections are dropped")
+)
+
+func serve() {
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	// Setup the logger
 	if *pretty {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -35,15 +129,75 @@ func main() {
 	}
 	zerolog.DurationFieldUnit = time.Millisecond
 	l := log.With().
+		Str("config", *configFile).
 		Str("loglevel", *level).
 		Str("bind", *bind).
 		Str("antivirus", *antivirusURL).
+		Str("tls", *tlsMode).
 		Str("certfile", *certFile).
 		Str("keyfile", *keyFile).
+		Dur("tlsreload", *tlsReload).
+		Str("tlsminversion", *tlsMinVersion).
+		Str("tlsciphers", *tlsCiphers).
+		Str("tlsalpn", *tlsALPN).
+		Str("grpcbind", *grpcBind).
+		Str("clamdbind", *clamdBind).
+		Bool("clamdtoken", *clamdToken != "").
+		Str("icapbind", *icapBind).
+		Str("icapblockpage", *icapBlockPage).
+		Int64("icapmaxecho", *icapMaxEcho).
+		Str("clientauth", *clientAuth).
+		Str("clientca", *clientCAFile).
+		Str("clientmap", *clientMapFile).
 		Bool("pretty", *pretty).
 		Str("usersfile", *usersFile).
+		Dur("usersreload", *usersReload).
+		Float64("ratelimit", *rateLimit).
+		Float64("rateburst", *rateBurst).
+		Float64("bytelimit", *byteLimit).
+		Float64("byteburst", *byteBurst).
+		Int("maxconcurrent", *maxConcurrent).
+		Int("scanslots", *scanSlots).
+		Int("scanqueue", *scanQueue).
+		Dur("scanqueuetimeout", *scanQueueTimeout).
+		Str("priorityheader", *priorityHeader).
+		Str("priorityroles", *priorityRoles).
+		Str("priorityweights", *priorityWeights).
+		Int("batchconcurrency", *batchConcurrency).
+		Int64("batchentrysize", *batchEntrySize).
+		Str("urlhosts", *urlHosts).
+		Str("urlschemes", *urlSchemes).
+		Str("urlnetworks", *urlNetworks).
+		Int64("urlmaxsize", *urlMaxSize).
+		Dur("urltimeout", *urlTimeout).
+		Int("urlredirects", *urlRedirects).
+		Str("s3endpoint", *s3Endpoint).
+		Str("s3region", *s3Region).
+		Str("s3accesskey", *s3AccessKey).
+		Str("s3buckets", *s3Buckets).
+		Str("s3quarantine", *s3Quarantine).
+		Str("usagefile", *usageFile).
+		Dur("usageflush", *usageFlush).
+		Int64("dailybytes", *dailyBytes).
+		Int64("dailyscans", *dailyScans).
+		Int64("monthlybytes", *monthlyBytes).
+		Int64("monthlyscans", *monthlyScans).
+		Str("authheader", *authHeader).
+		Bool("rawtokens", *rawTokens).
+		Str("jwks", *jwksLocation).
+		Dur("jwksrefresh", *jwksRefresh).
+		Str("jwtissuer", *jwtIssuer).
+		Str("jwtaudience", *jwtAudience).
+		Str("jwtuserclaim", *jwtUserClaim).
+		Str("jwtroleprefix", *jwtRolePrefix).
 		Bool("unixtime", *unixTime).
 		Bool("floatdur", *floatDurations).
+		Str("auditfile", *auditFile).
+		Int64("auditsize", *auditSize).
+		Int("auditkeep", *auditKeep).
+		Dur("healthinterval", *healthInterval).
+		Dur("draindelay", *drainDelay).
+		Dur("shutdowntimeout", *shutdownTimeout).
 		Logger()
 	loglevel, err := zerolog.ParseLevel(*level)
 	if err != nil {
@@ -51,34 +205,321 @@ func main() {
 	}
 	zerolog.SetGlobalLevel(loglevel)
 	zerolog.DurationFieldInteger = !*floatDurations
+	// Setup the audit trail
+	var audit *chowder.AuditLog
+	if *auditFile != "" {
+		af, seq, last, err := chowder.OpenAuditFile(*auditFile, *auditSize*1024*1024, *auditKeep)
+		if err != nil {
+			l.Fatal().Err(err).Msg("could not open audit file")
+		}
+		defer af.Close()
+		af.OnRotateFailure(func(err error) {
+			if err != nil {
+				l.Error().Err(err).Msg("audit file rotation is failing, records are still appended to the current file")
+				return
+			}
+			l.Info().Msg("audit file rotation recovered")
+		})
+		audit = chowder.NewAuditLog(af, seq, last)
+		if err = audit.Admin("", "start", "chowder started"); err != nil {
+			l.Fatal().Err(err).Msg("could not write audit file")
+		}
+	}
 	// Get the auth list
-	f, err := ioutil.ReadFile(*usersFile)
-	if err != nil && !os.IsNotExist(err) {
+	users, err := chowder.LoadUsers(*usersFile)
+	if err != nil {
 		l.Fatal().Err(err).Msg("could not load users file")
 	}
-	users := make(map[string]string)
-	err = yaml.Unmarshal(f, users)
+	go watchUsers(l, users, audit, *usersReload)
+	auth := chowder.Authenticators{users}
+	if *jwksLocation != "" {
+		keys, err := chowder.NewJWKS(*jwksLocation, *jwksRefresh)
+		if err != nil {
+			l.Fatal().Err(err).Msg("could not load jwks")
+		}
+		auth = append(auth, chowder.NewJWTAuth(keys, chowder.JWTOptions{
+			Issuer:          *jwtIssuer,
+			Audience:        *jwtAudience,
+			UserClaim:       *jwtUserClaim,
+			RoleScopePrefix: *jwtRolePrefix,
+		}))
+	}
+	// Setup client certificate authentication
+	clientAuthType, err := chowder.ParseClientAuth(*clientAuth)
 	if err != nil {
-		l.Fatal().Err(err).Msg("failed reading user list")
+		l.Fatal().Err(err).Msg("invalid client certificate mode")
+	}
+	authOpts := chowder.AuthOptions{
+		APIKeyHeader:   *authHeader,
+		AllowRawTokens: *rawTokens,
+		PublicPaths:    []string{"/livez", "/readyz"},
+	}
+	var clientCAs *x509.CertPool
+	if clientAuthType != tls.NoClientCert {
+		if *clientCAFile == "" {
+			l.Fatal().Msg("client certificate authentication requires a clientca bundle")
+		}
+		if clientCAs, err = chowder.LoadCertPool(*clientCAFile); err != nil {
+			l.Fatal().Err(err).Msg("could not load client CA bundle")
+		}
+		if authOpts.Certificates, err = chowder.LoadCertAuth(*clientMapFile); err != nil {
+			l.Fatal().Err(err).Msg("could not load client certificate mapping")
+		}
 	}
 	// Setup the router
-	proxy := &chowder.Proxy{AntiVirus: chowder.NewClamAV(*antivirusURL)}
+	av := chowder.NewClamAV(*antivirusURL)
+	health := chowder.NewHealthMonitor(*healthInterval)
+	health.Add(*antivirusURL, av)
+	health.OnChange(func(s chowder.BackendStatus) {
+		if s.Up {
+			l.Info().Str("backend", s.Name).Dur("latency", s.Latency).Msg("backend is up")
+			return
+		}
+		l.Warn().Str("backend", s.Name).Str("error", s.LastError).Msg("backend is down")
+	})
+	go health.Run(nil)
+	proxy := &chowder.Proxy{AntiVirus: av, Audit: audit, Health: health, BatchConcurrency: *batchConcurrency, BatchEntrySize: *batchEntrySize}
+	if *urlHosts != "" {
+		if proxy.Fetcher, err = chowder.NewURLFetcher(*urlSchemes, *urlHosts, *urlNetworks, *urlMaxSize, *urlTimeout, *urlRedirects); err != nil {
+			l.Fatal().Err(err).Msg("could not configure scanning by url")
+		}
+	}
+	if *s3Endpoint != "" {
+		client, err := chowder.NewS3Client(*s3Endpoint, *s3Region, *s3AccessKey, *s3SecretKey)
+		if err != nil {
+			l.Fatal().Err(err).Msg("could not configure scanning object storage")
+		}
+		proxy.S3 = chowder.NewS3Scanner(client, *s3Buckets, *s3Quarantine)
+	}
+	if *scanSlots > 0 {
+		proxy.Admission = chowder.NewAdmission(*scanSlots, *scanQueue, *scanQueueTimeout)
+		var high, normal, low int
+		if _, err := fmt.Sscanf(*priorityWeights, "%d,%d,%d", &high, &normal, &low); err != nil {
+			l.Fatal().Err(err).Msg("priorityweights must be three comma separated integers")
+		}
+		weights := chowder.DefaultPriorityWeights
+		weights[chowder.PriorityHigh], weights[chowder.PriorityNormal], weights[chowder.PriorityLow] = high, normal, low
+		proxy.Admission.SetWeights(weights)
+	}
+	priority := chowder.PriorityPolicy{Header: *priorityHeader, Roles: strings.Split(*priorityRoles, ",")}
+	limiter := chowder.NewRateLimiter(chowder.Limits{
+		Rate:       *rateLimit,
+		Burst:      *rateBurst,
+		Bytes:      *byteLimit,
+		BytesBurst: *byteBurst,
+		Concurrent: *maxConcurrent,
+	})
+	usage, err := chowder.OpenUsageStore(*usageFile, chowder.Quota{
+		DailyBytes:   *dailyBytes,
+		DailyScans:   *dailyScans,
+		MonthlyBytes: *monthlyBytes,
+		MonthlyScans: *monthlyScans,
+	})
+	if err != nil {
+		l.Fatal().Err(err).Msg("could not open usage file")
+	}
+	stopUsage, usageStopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(usageStopped)
+		usage.Run(*usageFlush, stopUsage, func(err error) {
+			l.Error().Err(err).Msg("failed persisting usage")
+		})
+	}()
+	// flushUsage stops the periodic flush after writing the counters one final time
+	flushUsage := func() {
+		close(stopUsage)
+		<-usageStopped
+	}
 	r := httprouter.New()
-	r.POST("/scan", proxy.Scan)
-	r.GET("/healthz", proxy.Ok)
-	r.GET("/metrics", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) { promhttp.Handler().ServeHTTP(w, r) })
-	api := chowder.LogRequests(log.With().Logger(), chowder.HeaderAuth(users, r))
-	l.Fatal().Err(listenAndServe(l, *bind, *certFile, *keyFile, api)).Msg("closed")
+	r.POST("/scan", chowder.RequireRole(chowder.RoleScanner, usage.Enforce(limiter.Limit(priority.Apply(proxy.Scan)))))
+	r.POST("/scan/batch", chowder.RequireRole(chowder.RoleScanner, usage.Enforce(limiter.Limit(priority.Apply(proxy.ScanBatch)))))
+	r.POST("/scan/url", chowder.RequireRole(chowder.RoleScanner, proxy.FetchURL(usage.Enforce(limiter.Limit(priority.Apply(proxy.ScanURL))))))
+	r.POST("/scan/s3", chowder.RequireRole(chowder.RoleScanner, proxy.FetchS3(usage.Enforce(limiter.Limit(priority.Apply(proxy.ScanS3))))))
+	r.POST("/s3/events", chowder.RequireRole(chowder.RoleScanner, usage.Enforce(limiter.Limit(priority.Apply(proxy.S3Events)))))
+	r.GET("/usage", usage.ServeUsage)
+	r.GET("/version", proxy.Version)
+	r.GET("/livez", proxy.Live)
+	r.GET("/readyz", proxy.Ready)
+	r.GET("/healthz", proxy.Healthz)
+	r.GET("/metrics", chowder.RequireRole(chowder.RoleReader, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) { promhttp.Handler().ServeHTTP(w, r) }))
+	api := chowder.LogRequests(log.With().Logger(), chowder.HeaderAuth(auth, authOpts, r))
+	minVersion, err := chowder.ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		l.Fatal().Err(err).Msg("invalid tls minimum version")
+	}
+	mode, err := chowder.ParseTLSMode(*tlsMode)
+	if err != nil {
+		l.Fatal().Err(err).Msg("invalid tls mode")
+	}
+	ciphers, err := chowder.ParseCipherSuites(*tlsCiphers)
+	if err != nil {
+		l.Fatal().Err(err).Msg("invalid tls cipher suites")
+	}
+	srv := &http.Server{
+		Addr:    *bind,
+		Handler: api,
+		TLSConfig: &tls.Config{
+			ClientCAs:    clientCAs,
+			ClientAuth:   clientAuthType,
+			MinVersion:   minVersion,
+			CipherSuites: ciphers,
+			NextProtos:   strings.Split(*tlsALPN, ","),
+		},
+	}
+	if !strings.Contains(","+*tlsALPN+",", ",h2,") {
+		// net/http enables HTTP/2 unless TLSNextProto is set
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	useTLS, err := configureTLS(l, srv.TLSConfig, mode, *certFile, *keyFile, *tlsReload)
+	if err != nil {
+		l.Fatal().Err(err).Msg("could not configure tls")
+	}
+	served := make(chan error, 4)
+	go func() {
+		served <- listenAndServe(l, srv, useTLS)
+	}()
+	servers := []chowder.Server{srv}
+	if *grpcBind != "" {
+		var opts []grpc.ServerOption
+		if useTLS {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(srv.TLSConfig)))
+		}
+		g := chowder.NewGRPCServer(api, proxy, time.Second, opts...)
+		servers = append(servers, g)
+		l.Info().Str("grpcbind", *grpcBind).Bool("tls", useTLS).Msg("starting grpc server")
+		go func() {
+			lis, err := net.Listen("tcp", *grpcBind)
+			if err != nil {
+				served <- err
+				return
+			}
+			served <- g.Serve(lis)
+		}()
+	}
+	if *clamdBind != "" {
+		clamd := &chowder.ClamdServer{Handler: api, Token: *clamdToken, IdleTimeout: 30 * time.Second}
+		servers = append(servers, clamd)
+		l.Info().Str("clamdbind", *clamdBind).Msg("starting clamd protocol server")
+		go func() {
+			served <- clamd.ListenAndServe(*clamdBind)
+		}()
+	}
+	if *icapBind != "" {
+		icap := &chowder.ICAPServer{Handler: api, Preview: 4096, MaxEcho: *icapMaxEcho, IdleTimeout: 30 * time.Second}
+		if *icapBlockPage != "" {
+			if icap.BlockPage, err = template.ParseFiles(*icapBlockPage); err != nil {
+				l.Fatal().Err(err).Msg("could not load icap block page")
+			}
+		}
+		servers = append(servers, icap)
+		l.Info().Str("icapbind", *icapBind).Msg("starting icap server")
+		go func() {
+			served <- icap.ListenAndServe(*icapBind)
+		}()
+	}
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-served:
+		flushUsage()
+		l.Fatal().Err(err).Msg("closed")
+	case sig := <-stop:
+		l.Info().Str("signal", sig.String()).Msg("received signal, shutting down")
+	}
+	go func() {
+		sig := <-stop
+		l.Fatal().Str("signal", sig.String()).Msg("received second signal, exiting without draining")
+	}()
+	if err := chowder.Shutdown(l, proxy, *drainDelay, *shutdownTimeout, servers...); err != nil {
+		l.Error().Err(err).Msg("shutdown did not complete cleanly")
+	}
+	flushUsage()
+	if err := audit.Admin("", "stop", "chowder stopped"); err != nil {
+		l.Error().Err(err).Msg("failed writing audit record")
+	}
+	l.Info().Msg("closed")
+}
+
+// watchUsers reloads the users file when it changes or on SIGHUP
+func watchUsers(l zerolog.Logger, users *chowder.Users, audit *chowder.AuditLog, interval time.Duration) {
+	reloaded := func(changed bool, err error) {
+		if err != nil {
+			l.Error().Err(err).Msg("failed reloading users file, keeping previous users")
+			return
+		}
+		if changed {
+			l.Info().Int("tokens", users.Len()).Msg("reloaded users file")
+			if err = audit.Admin("", "users-reload", fmt.Sprintf("%v tokens", users.Len())); err != nil {
+				l.Error().Err(err).Msg("failed writing audit record")
+			}
+		}
+	}
+	if interval > 0 {
+		go users.Watch(interval, nil, reloaded)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		l.Info().Msg("received SIGHUP, reloading users file")
+		reloaded(users.Reload())
+	}
 }
 
-// listenAndServe checks if either cert or keyfile exists, and if either does, serves HTTPS
-func listenAndServe(l zerolog.Logger, addr, certFile, keyFile string, handler http.Handler) error {
-	_, errCert := os.Stat(certFile)
-	_, errKey := os.Stat(keyFile)
-	if errCert == nil || errKey == nil {
-		l.Info().Msg("starting server")
-		return http.ListenAndServeTLS(addr, certFile, keyFile, handler)
-	}
-	l.Warn().Msg("no tls credentials found, starting server without tls")
-	return http.ListenAndServe(addr, handler)
+// configureTLS sets up config to serve the key pair from files (reloading it every reload) or a self
+// signed certificate as the tls mode decides, reporting whether tls is to be served
+func configureTLS(l zerolog.Logger, config *tls.Config, mode chowder.TLSMode, certFile, keyFile string, reload time.Duration) (bool, error) {
+	useFiles, err := mode.UseFiles(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case useFiles:
+		certs, err := chowder.NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return false, err
+		}
+		l.Info().Str("tls", string(mode)).Time("expiry", certs.Expiry()).Msg("serving tls")
+		config.GetCertificate = certs.GetCertificate
+		if reload > 0 {
+			go certs.Watch(reload, nil, func(changed bool, err error) {
+				if err != nil {
+					l.Error().Err(err).Msg("failed reloading tls credentials, keeping previous key pair")
+					return
+				}
+				l.Info().Time("expiry", certs.Expiry()).Msg("reloaded tls credentials")
+			})
+		}
+		return true, nil
+	case mode == chowder.TLSSelfSigned:
+		cert, err := chowder.SelfSignedCertificate([]string{"localhost", "127.0.0.1", "::1"}, 24*time.Hour)
+		if err != nil {
+			return false, err
+		}
+		l.Warn().Str("tls", string(mode)).Time("expiry", cert.Leaf.NotAfter).Msg("serving tls with an ephemeral self signed certificate, for development only")
+		config.Certificates = []tls.Certificate{cert}
+		return true, nil
+	case config.ClientAuth != tls.NoClientCert:
+		return false, errors.New("client certificate authentication requires tls")
+	case mode == chowder.TLSOff:
+		l.Warn().Str("tls", string(mode)).Msg("serving without tls as configured")
+	default:
+		l.Warn().Str("tls", string(mode)).Str("certfile", certFile).Str("keyfile", keyFile).Msg("no tls credentials found, serving without tls (set -tls required to refuse)")
+	}
+	return false, nil
+}
+
+// listenAndServe serves HTTPS as configured in the server's TLSConfig or else plaintext HTTP,
+// returning nil once the server is shut down
+func listenAndServe(l zerolog.Logger, srv *http.Server, useTLS bool) error {
+	l.Info().Bool("tls", useTLS).Msg("starting server")
+	var err error
+	if useTLS {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
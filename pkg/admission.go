@@ -0,0 +1,216 @@
+package chowder
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrOverloaded is returned when a scan cannot be admitted because the scanner is at capacity
+	ErrOverloaded     = errors.New("scanner is at capacity, retry later")
+	admissionInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chowder_admission_inflight",
+		Help: "The number of scans currently admitted to the antivirus",
+	})
+	admissionQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chowder_admission_queue_depth",
+		Help: "The number of scans waiting for admission to the antivirus by priority",
+	}, []string{"priority"})
+	admissionWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chowder_admission_wait_seconds",
+		Help:    "The time scans waited for admission to the antivirus in seconds by priority",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"priority"})
+	admissionRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_admission_rejected_total",
+		Help: "The total number of scans rejected by admission control by reason",
+	}, []string{"reason"})
+)
+
+// Admission bounds the number of concurrent scans sent to the antivirus (which should match clamd's
+// MaxThreads) and the number waiting behind them. Freed slots go to waiting scans by weighted round
+// robin across priorities, so high priority scans are served first without starving low priority ones.
+// When the queue is full a scan displaces the newest waiter of a lower priority, so background work
+// cannot fill the queue and lock interactive scans out.
+// A nil Admission admits everything immediately.
+type Admission struct {
+	slots    int
+	maxQueue int
+	timeout  time.Duration
+	weights  [priorities]int
+	mu       sync.Mutex
+	inflight int
+	queued   int
+	waiting  [priorities]*list.List
+	credit   [priorities]int
+}
+
+type admissionWaiter struct {
+	ready   chan struct{}
+	granted bool
+	evicted bool
+}
+
+// NewAdmission returns an Admission allowing slots concurrent scans with up to maxQueue more waiting
+// no longer than timeout (0 waits until the request is cancelled)
+func NewAdmission(slots, maxQueue int, timeout time.Duration) *Admission {
+	a := &Admission{
+		slots:    slots,
+		maxQueue: maxQueue,
+		timeout:  timeout,
+		weights:  DefaultPriorityWeights,
+	}
+	for i := range a.waiting {
+		a.waiting[i] = list.New()
+	}
+	return a
+}
+
+// SetWeights changes the share of freed slots each priority receives while scans of several priorities wait
+func (a *Admission) SetWeights(weights [priorities]int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, w := range weights {
+		if w < 1 {
+			weights[i] = 1
+		}
+	}
+	a.weights = weights
+}
+
+// RetryAfter is the delay suggested to clients that were refused admission
+func (a *Admission) RetryAfter() time.Duration {
+	if a == nil || a.timeout < time.Second {
+		return time.Second
+	}
+	return a.timeout
+}
+
+// Acquire waits for a scan slot at the priority carried by ctx, returning ErrOverloaded if the queue is
+// full or the wait times out. The returned release func must be called once the scan completes.
+func (a *Admission) Acquire(ctx context.Context) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	priority := getPriority(ctx)
+	start := time.Now()
+	a.mu.Lock()
+	if a.inflight < a.slots {
+		a.inflight++
+		a.mu.Unlock()
+		admissionInflight.Inc()
+		admissionWait.WithLabelValues(priority.String()).Observe(0)
+		return a.release, nil
+	}
+	if a.queued >= a.maxQueue && !a.evict(priority) {
+		a.mu.Unlock()
+		admissionRejected.WithLabelValues("queue_full").Inc()
+		return nil, ErrOverloaded
+	}
+	w := &admissionWaiter{ready: make(chan struct{})}
+	e := a.waiting[priority].PushBack(w)
+	a.queued++
+	a.mu.Unlock()
+	queued := admissionQueued.WithLabelValues(priority.String())
+	queued.Inc()
+	defer queued.Dec()
+	var timeout <-chan time.Time
+	if a.timeout > 0 {
+		t := time.NewTimer(a.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	reason := ""
+	select {
+	case <-w.ready:
+		if !w.granted {
+			reason = "evicted"
+		}
+	case <-timeout:
+		reason = "timeout"
+	case <-ctx.Done():
+		reason = "cancelled"
+	}
+	admissionWait.WithLabelValues(priority.String()).Observe(time.Since(start).Seconds())
+	if reason == "evicted" {
+		admissionRejected.WithLabelValues(reason).Inc()
+		return nil, ErrOverloaded
+	}
+	if reason != "" {
+		a.mu.Lock()
+		granted := w.granted
+		if !granted && !w.evicted {
+			a.waiting[priority].Remove(e)
+			a.queued--
+		}
+		a.mu.Unlock()
+		if granted {
+			// the slot was handed over as we gave up, pass it on
+			a.release()
+		}
+		admissionRejected.WithLabelValues(reason).Inc()
+		if reason == "cancelled" {
+			return nil, ctx.Err()
+		}
+		return nil, ErrOverloaded
+	}
+	return a.release, nil
+}
+
+// release hands the slot to the next waiting scan or frees it
+func (a *Admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p, ok := a.next(); ok {
+		w := a.waiting[p].Remove(a.waiting[p].Front()).(*admissionWaiter)
+		a.queued--
+		w.granted = true
+		close(w.ready)
+		return
+	}
+	a.inflight--
+	admissionInflight.Dec()
+}
+
+// evict refuses the newest waiting scan of the lowest priority below p to make room for a scan at p,
+// the caller must hold the lock
+func (a *Admission) evict(p Priority) bool {
+	for _, lower := range []Priority{PriorityLow, PriorityNormal} {
+		if lower.rank() >= p.rank() || a.waiting[lower].Len() == 0 {
+			continue
+		}
+		w := a.waiting[lower].Remove(a.waiting[lower].Back()).(*admissionWaiter)
+		a.queued--
+		w.evicted = true
+		close(w.ready)
+		return true
+	}
+	return false
+}
+
+// next picks the priority to serve by smooth weighted round robin over the non-empty queues
+func (a *Admission) next() (Priority, bool) {
+	total, best := 0, -1
+	for p := range a.waiting {
+		if a.waiting[p].Len() == 0 {
+			a.credit[p] = 0
+			continue
+		}
+		a.credit[p] += a.weights[p]
+		total += a.weights[p]
+		if best < 0 || a.credit[p] > a.credit[best] {
+			best = p
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	a.credit[best] -= total
+	return Priority(best), true
+}
@@ -0,0 +1,96 @@
+package chowder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionQueuesBehindSlots(t *testing.T) {
+	sut := NewAdmission(1, 1, time.Second)
+	release, err := sut.Acquire(context.Background())
+	assert.Nil(t, err)
+
+	admitted := make(chan func())
+	go func() {
+		r, err := sut.Acquire(context.Background())
+		assert.Nil(t, err)
+		admitted <- r
+	}()
+	assert.Eventually(t, func() bool {
+		sut.mu.Lock()
+		defer sut.mu.Unlock()
+		return sut.queued == 1
+	}, time.Second, time.Millisecond)
+	_, err = sut.Acquire(context.Background())
+	assert.Equal(t, ErrOverloaded, err)
+
+	release()
+	(<-admitted)()
+	sut.mu.Lock()
+	assert.Equal(t, 0, sut.inflight)
+	sut.mu.Unlock()
+}
+
+func TestAdmissionTimesOutWaiting(t *testing.T) {
+	sut := NewAdmission(1, 5, 10*time.Millisecond)
+	release, _ := sut.Acquire(context.Background())
+
+	_, err := sut.Acquire(context.Background())
+	assert.Equal(t, ErrOverloaded, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sut.Acquire(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	release()
+	release, err = sut.Acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+}
+
+func TestNilAdmissionAdmitsEverything(t *testing.T) {
+	var sut *Admission
+	release, err := sut.Acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+	assert.Equal(t, time.Second, sut.RetryAfter())
+}
+
+func TestAdmissionEvictsLowerPriorityWhenFull(t *testing.T) {
+	sut := NewAdmission(1, 1, time.Second)
+	release, err := sut.Acquire(context.Background())
+	assert.Nil(t, err)
+	queued := func(n int) func() bool {
+		return func() bool {
+			sut.mu.Lock()
+			defer sut.mu.Unlock()
+			return sut.queued == n
+		}
+	}
+
+	evicted := make(chan error)
+	go func() {
+		_, err := sut.Acquire(WithPriority(context.Background(), PriorityLow))
+		evicted <- err
+	}()
+	assert.Eventually(t, queued(1), time.Second, time.Millisecond)
+	admitted := make(chan func())
+	go func() {
+		r, err := sut.Acquire(WithPriority(context.Background(), PriorityHigh))
+		assert.Nil(t, err)
+		admitted <- r
+	}()
+	assert.Equal(t, ErrOverloaded, <-evicted)
+	assert.Eventually(t, queued(1), time.Second, time.Millisecond)
+	// scans cannot displace those of the same or a higher priority
+	_, err = sut.Acquire(WithPriority(context.Background(), PriorityHigh))
+	assert.Equal(t, ErrOverloaded, err)
+	_, err = sut.Acquire(context.Background())
+	assert.Equal(t, ErrOverloaded, err)
+
+	release()
+	(<-admitted)()
+}
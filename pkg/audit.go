@@ -0,0 +1,318 @@
+package chowder
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// AuditKindScan marks an audit record describing a scan decision
+	AuditKindScan = "scan"
+	// AuditKindAdmin marks an audit record describing an administrative action
+	AuditKindAdmin = "admin"
+)
+
+var (
+	auditRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_audit_records_total",
+		Help: "The total number of audit records written by kind",
+	}, []string{"kind"})
+	auditFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chowder_audit_failures_total",
+		Help: "The total number of audit records that could not be written",
+	})
+	auditRotationFailing = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chowder_audit_rotation_failing",
+		Help: "Whether the audit file could not be rotated and is growing beyond its maximum size",
+	})
+	_ io.WriteCloser = &AuditFile{}
+)
+
+// AuditRecord is a single hash chained entry in the audit trail
+type AuditRecord struct {
+	Sequence uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	User     string    `json:"user,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Action   string    `json:"action"`
+	Outcome  string    `json:"outcome,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Previous string    `json:"prev"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+// digest returns the chain hash for the record, which covers every field but the hash itself
+func (rec AuditRecord) digest() (string, error) {
+	rec.Hash = ""
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog writes one hash chained JSON record per line, a nil AuditLog discards all records
+type AuditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	seq  uint64
+	last string
+	now  func() time.Time
+}
+
+// NewAuditLog returns an AuditLog writing to w that continues the chain from the supplied sequence and hash
+func NewAuditLog(w io.Writer, seq uint64, last string) *AuditLog {
+	return &AuditLog{
+		w:    w,
+		seq:  seq,
+		last: last,
+		now:  time.Now,
+	}
+}
+
+// Record completes the sequence, time and chain fields of rec and appends it to the trail
+func (a *AuditLog) Record(rec AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec.Sequence = a.seq + 1
+	rec.Time = a.now().UTC()
+	rec.Previous = a.last
+	hash, err := rec.digest()
+	if err != nil {
+		auditFailures.Inc()
+		return fmt.Errorf("failed hashing audit record: %v", err)
+	}
+	rec.Hash = hash
+	b, err := json.Marshal(rec)
+	if err != nil {
+		auditFailures.Inc()
+		return fmt.Errorf("failed encoding audit record: %v", err)
+	}
+	// a single write per record keeps lines whole when the writer is shared or rotated
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		auditFailures.Inc()
+		return fmt.Errorf("failed writing audit record: %v", err)
+	}
+	a.seq = rec.Sequence
+	a.last = rec.Hash
+	auditRecords.WithLabelValues(rec.Kind).Inc()
+	return nil
+}
+
+// Admin records an administrative action taken by user
+func (a *AuditLog) Admin(user, action, detail string) error {
+	return a.Record(AuditRecord{
+		Kind:   AuditKindAdmin,
+		User:   user,
+		Action: action,
+		Detail: detail,
+	})
+}
+
+// ErrAuditChainBroken is returned when an audit trail fails verification
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// AuditVerifier checks that records read across one or more audit files form an unbroken chain
+type AuditVerifier struct {
+	// Records is the number of records verified so far
+	Records int
+	// First is the first record verified, its previous hash anchors the chain
+	First *AuditRecord
+	seq   uint64
+	last  string
+}
+
+// Verify reads every record from r checking that each hash is correct and links to the record before it
+func (v *AuditVerifier) Verify(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%w: line %v is not a record: %v", ErrAuditChainBroken, line, err)
+		}
+		hash, err := rec.digest()
+		if err != nil {
+			return err
+		}
+		if hash != rec.Hash {
+			return fmt.Errorf("%w: line %v (seq %v) hash mismatch, record was modified", ErrAuditChainBroken, line, rec.Sequence)
+		}
+		if v.First != nil {
+			if rec.Previous != v.last {
+				return fmt.Errorf("%w: line %v (seq %v) does not follow seq %v", ErrAuditChainBroken, line, rec.Sequence, v.seq)
+			}
+			if rec.Sequence != v.seq+1 {
+				return fmt.Errorf("%w: line %v has seq %v, expected %v", ErrAuditChainBroken, line, rec.Sequence, v.seq+1)
+			}
+		} else {
+			first := rec
+			v.First = &first
+		}
+		v.seq = rec.Sequence
+		v.last = rec.Hash
+		v.Records++
+	}
+	return s.Err()
+}
+
+// AuditFile is an append only audit file that rotates once it grows beyond a maximum size
+type AuditFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	size    int64
+	f       *os.File
+	err     error
+	failed  func(error)
+}
+
+// OpenAuditFile opens (or creates) the audit file at path, returning it along with the sequence and hash
+// of its last record so that a new AuditLog can continue the chain. A maxSize of 0 disables rotation and
+// keep is the number of rotated files retained as path.1 (newest) through path.keep (oldest).
+func OpenAuditFile(path string, maxSize int64, keep int) (*AuditFile, uint64, string, error) {
+	seq, last, err := lastAuditRecord(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	af := &AuditFile{path: path, maxSize: maxSize, keep: keep}
+	if err = af.open(); err != nil {
+		return nil, 0, "", err
+	}
+	return af, seq, last, nil
+}
+
+// Write appends p to the audit file, rotating first if p would take it beyond the maximum size
+func (af *AuditFile) Write(p []byte) (int, error) {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	if af.maxSize > 0 && af.size > 0 && af.size+int64(len(p)) > af.maxSize {
+		af.rotated(af.rotate())
+	}
+	n, err := af.f.Write(p)
+	af.size += int64(n)
+	return n, err
+}
+
+// OnRotateFailure sets a func called when rotation starts failing, and with nil once it succeeds again.
+// A failed rotation keeps appending to the current file so that no records are lost.
+func (af *AuditFile) OnRotateFailure(failed func(error)) {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	af.failed = failed
+}
+
+// Err returns why the audit file last failed to rotate, or nil if rotation is working
+func (af *AuditFile) Err() error {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	return af.err
+}
+
+// Close closes the underlying file
+func (af *AuditFile) Close() error {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	return af.f.Close()
+}
+
+func (af *AuditFile) open() error {
+	f, err := os.OpenFile(af.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not stat audit file: %v", err)
+	}
+	af.f = f
+	af.size = info.Size()
+	return nil
+}
+
+// rotated records the outcome of a rotation, reporting when it starts or stops failing
+func (af *AuditFile) rotated(err error) {
+	changed := (err == nil) != (af.err == nil)
+	af.err = err
+	if err != nil {
+		auditRotationFailing.Set(1)
+	} else {
+		auditRotationFailing.Set(0)
+	}
+	if changed && af.failed != nil {
+		af.failed(err)
+	}
+}
+
+// rotate moves the current file aside and starts a new one. The current file stays open until its
+// replacement is, so that a failure part way through leaves writes going somewhere in the chain.
+func (af *AuditFile) rotate() error {
+	if af.keep < 1 {
+		if err := os.Remove(af.path); err != nil {
+			return fmt.Errorf("could not remove audit file for rotation: %v", err)
+		}
+	} else {
+		os.Remove(fmt.Sprintf("%v.%v", af.path, af.keep))
+		for i := af.keep - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%v.%v", af.path, i), fmt.Sprintf("%v.%v", af.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("could not rotate audit file: %v", err)
+			}
+		}
+		if err := os.Rename(af.path, af.path+".1"); err != nil {
+			return fmt.Errorf("could not rotate audit file: %v", err)
+		}
+	}
+	old := af.f
+	if err := af.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// lastAuditRecord finds the newest record in the audit file at path or its most recent rotation
+func lastAuditRecord(path string) (uint64, string, error) {
+	for _, p := range []string{path, path + ".1"} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, "", fmt.Errorf("could not read audit file: %v", err)
+		}
+		v := &AuditVerifier{}
+		err = v.Verify(f)
+		f.Close()
+		if err != nil {
+			return 0, "", fmt.Errorf("refusing to extend audit file %v: %w", p, err)
+		}
+		if v.Records > 0 {
+			return v.seq, v.last, nil
+		}
+	}
+	return 0, "", nil
+}
@@ -0,0 +1,119 @@
+package chowder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogChainsRecords(t *testing.T) {
+	w := &strings.Builder{}
+	sut := NewAuditLog(w, 0, "")
+
+	assert.Nil(t, sut.Admin("root", "start", "started"))
+	assert.Nil(t, sut.Record(AuditRecord{Kind: AuditKindScan, Action: "scan", Outcome: "clean"}))
+
+	v := &AuditVerifier{}
+	assert.Nil(t, v.Verify(strings.NewReader(w.String())))
+	assert.Equal(t, 2, v.Records)
+	assert.Equal(t, "", v.First.Previous)
+	assert.Equal(t, uint64(1), v.First.Sequence)
+}
+
+func TestAuditVerifierDetectsTampering(t *testing.T) {
+	w := &strings.Builder{}
+	sut := NewAuditLog(w, 0, "")
+	sut.Record(AuditRecord{Kind: AuditKindScan, Action: "scan", Outcome: "infected"})
+	sut.Record(AuditRecord{Kind: AuditKindScan, Action: "scan", Outcome: "clean"})
+
+	tampered := strings.Replace(w.String(), "infected", "clean", 1)
+	err := (&AuditVerifier{}).Verify(strings.NewReader(tampered))
+
+	assert.True(t, errors.Is(err, ErrAuditChainBroken))
+	assert.Contains(t, err.Error(), "hash mismatch")
+}
+
+func TestAuditVerifierDetectsRemovedRecords(t *testing.T) {
+	w := &strings.Builder{}
+	sut := NewAuditLog(w, 0, "")
+	sut.Admin("", "one", "")
+	sut.Admin("", "two", "")
+	sut.Admin("", "three", "")
+	lines := strings.SplitAfter(w.String(), "\n")
+
+	err := (&AuditVerifier{}).Verify(strings.NewReader(lines[0] + lines[2]))
+
+	assert.True(t, errors.Is(err, ErrAuditChainBroken))
+	assert.Contains(t, err.Error(), "does not follow")
+}
+
+func TestAuditFileRotatesAndContinuesChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	af, seq, last, err := OpenAuditFile(path, 600, 5)
+	assert.Nil(t, err)
+	sut := NewAuditLog(af, seq, last)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, sut.Admin("root", "rotate", "filling the audit file"))
+	}
+	af.Close()
+	af, seq, last, err = OpenAuditFile(path, 600, 5)
+	assert.Nil(t, err)
+	sut = NewAuditLog(af, seq, last)
+	assert.Nil(t, sut.Admin("root", "reopen", ""))
+	af.Close()
+
+	v := &AuditVerifier{}
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		f, err := os.Open(p)
+		assert.Nil(t, err)
+		assert.Nil(t, v.Verify(f))
+		f.Close()
+	}
+	assert.Equal(t, uint64(4), seq)
+	assert.Equal(t, 5, v.Records)
+}
+
+func TestAuditFileKeepsWritingWhenRotationFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	// a non-empty directory where the rotated file belongs makes the rename fail
+	assert.Nil(t, os.MkdirAll(filepath.Join(path+".2", "blocked"), 0700))
+
+	af, seq, last, err := OpenAuditFile(path, 300, 2)
+	assert.Nil(t, err)
+	var failures []error
+	af.OnRotateFailure(func(err error) { failures = append(failures, err) })
+	sut := NewAuditLog(af, seq, last)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, sut.Admin("root", "rotate", "filling the audit file"))
+	}
+	assert.Len(t, failures, 1)
+	assert.NotNil(t, af.Err())
+
+	assert.Nil(t, os.RemoveAll(path+".2"))
+	assert.Nil(t, sut.Admin("root", "rotate", "rotation recovered"))
+	af.Close()
+	assert.Len(t, failures, 2)
+	assert.Nil(t, failures[1])
+	assert.Nil(t, af.Err())
+
+	v := &AuditVerifier{}
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		f, err := os.Open(p)
+		assert.Nil(t, err)
+		assert.Nil(t, v.Verify(f))
+		f.Close()
+	}
+	assert.Equal(t, 5, v.Records)
+}
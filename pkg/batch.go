@@ -0,0 +1,289 @@
+package chowder
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultBatchConcurrency is how many entries of a batch are scanned at once if not set
+	DefaultBatchConcurrency = 4
+	// DefaultBatchEntrySize bounds each entry of a batch if not set, as entries are held in memory to be
+	// scanned while the next ones are read
+	DefaultBatchEntrySize = 1 << 20
+)
+
+var batchEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chowder_batch_entries_total",
+	Help: "The total number of batch scan entries by outcome",
+}, []string{"outcome"})
+
+// BatchSummary is the last line of a streamed batch scan
+type BatchSummary struct {
+	Summary ReportSummary `json:"summary"`
+}
+
+// batchEntry is an entry read from a batch, with err set if it cannot be scanned
+type batchEntry struct {
+	name string
+	data []byte
+	size int64
+	err  string
+}
+
+// ScanBatch scans every entry of a tar stream (Content-Type application/x-tar) or of newline delimited json
+// items of the form {"name": "...", "data": "<base64>"} (Content-Type application/x-ndjson). Results are
+// streamed back as a json FileResult line per entry as each completes, ending with a BatchSummary line, or
+// with an error line if the batch could not be read to the end. With ?format= set to one of ReportFormats
+// the whole report is returned in that format once the batch is done instead.
+func (p *Proxy) ScanBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	format := r.URL.Query().Get("format")
+	if _, ok := reportContentTypes[format]; format != "" && !ok {
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusBadRequest),
+			Message: fmt.Sprintf("unknown format '%v'", format),
+		}, http.StatusBadRequest)
+		return
+	}
+	limit := p.BatchEntrySize
+	if limit <= 0 {
+		limit = DefaultBatchEntrySize
+	}
+	var next func() (*batchEntry, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-tar", "application/tar":
+		next = tarEntries(r.Body, limit)
+	case "application/x-ndjson", "application/jsonl":
+		next = ndjsonEntries(r.Body, limit)
+	default:
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusUnsupportedMediaType),
+			Message: "batches must be application/x-tar or application/x-ndjson",
+		}, http.StatusUnsupportedMediaType)
+		return
+	}
+	start := time.Now()
+	results, done := p.scanEntries(r, next)
+	var all []FileResult
+	var enc *json.Encoder
+	flusher, _ := w.(http.Flusher)
+	// results can only be written while the batch is still being read if the connection is full duplex,
+	// otherwise they are held back until it has been
+	streaming := format == "" && enableFullDuplex(w, r)
+	if streaming {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		enc = json.NewEncoder(w)
+	}
+	for res := range results {
+		all = append(all, res)
+		if enc == nil {
+			continue
+		}
+		enc.Encode(res)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	readErr := <-done
+	if format == "" && !streaming {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		enc = json.NewEncoder(w)
+		for _, res := range all {
+			enc.Encode(res)
+		}
+	}
+	report := NewReport(all, time.Since(start))
+	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+		l = l.Int("batch-entries", report.Summary.Files).Int("infected", report.Summary.Infected).Int("scan-errors", report.Summary.Errors)
+		if readErr != nil {
+			l = l.Str("batch-error", readErr.Error())
+		}
+		return l
+	})
+	if enc != nil {
+		if readErr != nil {
+			enc.Encode(&Response{Error: http.StatusText(http.StatusBadRequest), Message: readErr.Error()})
+			return
+		}
+		enc.Encode(&BatchSummary{Summary: report.Summary})
+		return
+	}
+	if readErr != nil {
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusBadRequest),
+			Message: readErr.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", reportContentTypes[format])
+	w.WriteHeader(http.StatusOK)
+	report.Write(w, format)
+}
+
+// scanEntries reads entries with next and scans them concurrently, sending each result as it completes.
+// Once the batch is read and scanned the results are closed and done receives the error that stopped
+// reading the batch, nil if it was read to the end.
+func (p *Proxy) scanEntries(r *http.Request, next func() (*batchEntry, error)) (<-chan FileResult, <-chan error) {
+	concurrency := p.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	entries := make(chan *batchEntry)
+	results := make(chan FileResult)
+	done := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				results <- p.scanEntry(r, e)
+			}
+		}()
+	}
+	go func() {
+		var err error
+		defer func() {
+			close(entries)
+			wg.Wait()
+			done <- err
+			close(results)
+		}()
+		for {
+			var e *batchEntry
+			if e, err = next(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			select {
+			case entries <- e:
+			case <-r.Context().Done():
+				err = r.Context().Err()
+				return
+			}
+		}
+	}()
+	return results, done
+}
+
+// scanEntry scans an entry of a batch, admitted and audited like a scan of its own
+func (p *Proxy) scanEntry(r *http.Request, e *batchEntry) FileResult {
+	res := FileResult{Path: e.name, Size: e.size}
+	defer func() {
+		switch {
+		case res.Error != "":
+			batchEntries.WithLabelValues("error").Inc()
+		case res.Infected:
+			batchEntries.WithLabelValues("infected").Inc()
+		default:
+			batchEntries.WithLabelValues("clean").Inc()
+		}
+	}()
+	if e.err != "" {
+		res.Error = e.err
+		return res
+	}
+	start := time.Now()
+	infected, msg, err := p.scanAdmitted(r, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(e.data)), nil
+	})
+	res.Duration = time.Since(start)
+	if _, refused := err.(*httpError); refused {
+		res.Error = err.Error()
+		return res
+	}
+	if err == nil {
+		reportScanned(r.Context())
+	}
+	res.setVerdict(infected, msg, err)
+	return res
+}
+
+// tarEntries reads the regular files of a tar stream, skipping directories, links and the like
+func tarEntries(body io.Reader, limit int64) func() (*batchEntry, error) {
+	tr := tar.NewReader(body)
+	return func() (*batchEntry, error) {
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil, err
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not read tar: %v", err)
+			}
+			if !hdr.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			e := &batchEntry{name: hdr.Name, size: hdr.Size}
+			if hdr.Size > limit {
+				e.err = fmt.Sprintf("entry larger than %v bytes", limit)
+				return e, nil
+			}
+			e.data = make([]byte, hdr.Size)
+			if _, err = io.ReadFull(tr, e.data); err != nil {
+				return nil, fmt.Errorf("could not read tar entry %v: %v", hdr.Name, err)
+			}
+			return e, nil
+		}
+	}
+}
+
+// ndjsonEntries reads newline delimited json items holding base64 encoded data
+func ndjsonEntries(body io.Reader, limit int64) func() (*batchEntry, error) {
+	sc := bufio.NewScanner(body)
+	// base64 takes 4 bytes for every 3, with room for the name and punctuation
+	max := int(limit/3*4) + 4096
+	sc.Buffer(make([]byte, 0, 64*1024), max)
+	line := 0
+	return func() (*batchEntry, error) {
+		for sc.Scan() {
+			line++
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			var item struct {
+				Name string `json:"name"`
+				Data []byte `json:"data"`
+			}
+			e := &batchEntry{name: fmt.Sprintf("line %v", line)}
+			if err := json.Unmarshal(sc.Bytes(), &item); err != nil {
+				e.err = fmt.Sprintf("could not decode item: %v", err)
+				return e, nil
+			}
+			if item.Name != "" {
+				e.name = item.Name
+			}
+			e.data, e.size = item.Data, int64(len(item.Data))
+			if e.size > limit {
+				e.data, e.err = nil, fmt.Sprintf("entry larger than %v bytes", limit)
+			}
+			return e, nil
+		}
+		if err := sc.Err(); err != nil {
+			if err == bufio.ErrTooLong {
+				return nil, fmt.Errorf("line %v is longer than %v bytes", line+1, max)
+			}
+			return nil, fmt.Errorf("could not read items: %v", err)
+		}
+		return nil, io.EOF
+	}
+}
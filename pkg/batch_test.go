@@ -0,0 +1,154 @@
+package chowder
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func batchServer(p *Proxy) *httptest.Server {
+	r := httprouter.New()
+	r.POST("/scan/batch", p.ScanBatch)
+	return httptest.NewServer(LogRequests(zerolog.Nop(), r))
+}
+
+func writeTarEntry(t *testing.T, tw *tar.Writer, name, content string) {
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(content))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Flush())
+}
+
+func TestScanBatchStreamsTarResults(t *testing.T) {
+	ts := batchServer(&Proxy{AntiVirus: contentScanner{}})
+	defer ts.Close()
+	pr, pw := io.Pipe()
+	tw := tar.NewWriter(pw)
+	wrote := make(chan struct{})
+	go func() {
+		defer close(wrote)
+		writeTarEntry(t, tw, "pkg/eicar.com", "X5O EICAR")
+	}()
+
+	resp, err := http.Post(ts.URL+"/scan/batch", "application/x-tar", pr)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	lines := bufio.NewScanner(resp.Body)
+
+	// the first result arrives while the rest of the batch is still to be sent
+	assert.True(t, lines.Scan())
+	first := FileResult{}
+	assert.Nil(t, json.Unmarshal(lines.Bytes(), &first))
+	assert.Equal(t, "pkg/eicar.com", first.Path)
+	assert.Equal(t, "Eicar-Test-Signature", first.Signature)
+
+	go func() {
+		<-wrote
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "pkg/", Mode: 0755, Typeflag: tar.TypeDir}))
+		writeTarEntry(t, tw, "pkg/readme.txt", "hello")
+		assert.Nil(t, tw.Close())
+		pw.Close()
+	}()
+	assert.True(t, lines.Scan())
+	second := FileResult{}
+	assert.Nil(t, json.Unmarshal(lines.Bytes(), &second))
+	assert.Equal(t, FileResult{Path: "pkg/readme.txt", Size: 5, Message: "stream: OK"}, second)
+	assert.True(t, lines.Scan())
+	summary := BatchSummary{}
+	assert.Nil(t, json.Unmarshal(lines.Bytes(), &summary))
+	assert.Equal(t, ReportSummary{Files: 2, Bytes: 14, Clean: 1, Infected: 1}, summary.Summary)
+	assert.False(t, lines.Scan())
+}
+
+func TestScanBatchReportsNDJSONItems(t *testing.T) {
+	ts := batchServer(&Proxy{AntiVirus: contentScanner{}, BatchEntrySize: 8})
+	defer ts.Close()
+	body := `{"name": "a.txt", "data": "aGVsbG8="}
+
+{"name": "b.com", "data": "RUlDQVI="}
+{"name": "big.bin", "data": "MDEyMzQ1Njc4OQ=="}
+not json
+`
+
+	resp, err := http.Post(ts.URL+"/scan/batch?format=junit", "application/x-ndjson", strings.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/xml", resp.Header.Get("Content-Type"))
+	got := string(b)
+	assert.Contains(t, got, `<testsuite name="chowder" tests="4" failures="1" errors="2"`)
+	assert.Contains(t, got, `<testcase name="a.txt" classname="chowder.scan"`)
+	assert.Contains(t, got, `<failure message="Eicar-Test-Signature FOUND" type="Eicar-Test-Signature">`)
+	assert.Contains(t, got, `<error message="entry larger than 8 bytes">`)
+	assert.Contains(t, got, `<testcase name="line 5" classname="chowder.scan"`)
+}
+
+func TestScanBatchRejectsBadRequests(t *testing.T) {
+	ts := batchServer(&Proxy{AntiVirus: contentScanner{}})
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/scan/batch", "text/plain", strings.NewReader("hello"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/scan/batch?format=xml", "application/x-tar", strings.NewReader(""))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/scan/batch?format=sarif", "application/x-tar", strings.NewReader("not a tar stream"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// once streaming has started a broken batch ends with an error line
+	resp, err = http.Post(ts.URL+"/scan/batch", "application/x-tar", strings.NewReader("not a tar stream"))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	last := &Response{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(last))
+	assert.Equal(t, "could not read tar: unexpected EOF", last.Message)
+}
+
+func TestScanBatchChargesEachEntryAgainstScanQuotas(t *testing.T) {
+	users, err := NewUsers(map[string]UserEntry{"token": {User: "ci", Quota: &Quota{DailyScans: 3}}})
+	assert.Nil(t, err)
+	usage, err := OpenUsageStore("", Quota{})
+	assert.Nil(t, err)
+	p := &Proxy{AntiVirus: contentScanner{}}
+	r := httprouter.New()
+	r.POST("/scan/batch", usage.Enforce(p.ScanBatch))
+	ts := httptest.NewServer(LogRequests(zerolog.Nop(), HeaderAuth(users, AuthOptions{}, r)))
+	defer ts.Close()
+	post := func(body string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/scan/batch?format=json", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// entries that could not be scanned are not charged
+	assert.Equal(t, http.StatusOK, post("{\"data\": \"aGVsbG8=\"}\n{\"data\": \"aGVsbG8=\"}\nnot json\n"))
+	assert.Equal(t, int64(2), usage.Get("ci").Daily.Scans)
+	assert.Equal(t, http.StatusOK, post("{\"data\": \"aGVsbG8=\"}\n{\"data\": \"aGVsbG8=\"}\n"))
+	assert.Equal(t, int64(4), usage.Get("ci").Daily.Scans)
+	assert.Equal(t, http.StatusTooManyRequests, post("{\"data\": \"aGVsbG8=\"}\n"))
+}
@@ -0,0 +1,124 @@
+package chowder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CertUser is the user and roles a client certificate identity maps to, without roles it is granted DefaultRoles
+type CertUser struct {
+	User  string   `yaml:"user"`
+	Roles []string `yaml:"roles"`
+}
+
+// CertAuth identifies callers by their verified TLS client certificate. Without a mapping the
+// certificate's first URI SAN, DNS SAN, email SAN or subject common name is used as the username.
+type CertAuth struct {
+	mapping map[string]CertUser
+}
+
+// NewCertAuth returns a CertAuth using the supplied mapping of certificate identity to user, which may be nil
+func NewCertAuth(mapping map[string]CertUser) *CertAuth {
+	return &CertAuth{mapping: mapping}
+}
+
+// LoadCertAuth reads a yaml mapping file of certificate identity (URI, DNS or email SAN, or subject
+// common name) to `{user: name, roles: [...]}`, an empty path maps certificates without a file
+func LoadCertAuth(path string) (*CertAuth, error) {
+	if path == "" {
+		return NewCertAuth(nil), nil
+	}
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate mapping: %v", err)
+	}
+	mapping := make(map[string]CertUser)
+	if err = yaml.UnmarshalStrict(f, mapping); err != nil {
+		return nil, fmt.Errorf("failed reading client certificate mapping: %v", err)
+	}
+	for identity, u := range mapping {
+		if u.User == "" {
+			return nil, fmt.Errorf("client certificate identity '%v' has no user", identity)
+		}
+		if err = validateRoles(u.Roles); err != nil {
+			return nil, fmt.Errorf("client certificate identity '%v': %v", identity, err)
+		}
+	}
+	return NewCertAuth(mapping), nil
+}
+
+// AuthenticateRequest returns the Identity of the verified client certificate on r, if there is one
+func (c *CertAuth) AuthenticateRequest(r *http.Request) (*Identity, bool) {
+	if c == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return c.Identify(r.TLS.VerifiedChains[0][0])
+}
+
+// Identify maps a (previously verified) certificate to an Identity
+func (c *CertAuth) Identify(cert *x509.Certificate) (*Identity, bool) {
+	names := certIdentities(cert)
+	if c.mapping == nil {
+		if len(names) == 0 {
+			return nil, false
+		}
+		return &Identity{User: names[0], Method: "cert", Roles: DefaultRoles}, true
+	}
+	for _, name := range names {
+		if u, ok := c.mapping[name]; ok {
+			roles := u.Roles
+			if len(roles) == 0 {
+				roles = DefaultRoles
+			}
+			return &Identity{User: u.User, Method: "cert", Roles: roles}, true
+		}
+	}
+	return nil, false
+}
+
+// certIdentities lists the names a certificate asserts, most specific first
+func certIdentities(cert *x509.Certificate) []string {
+	var names []string
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("CA bundle contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+// ParseClientAuth converts a client certificate mode of none, verify (if given) or require to a tls.ClientAuthType
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "verify":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("client certificate mode '%v' must be one of none, verify or require", mode)
+}
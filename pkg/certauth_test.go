@@ -0,0 +1,141 @@
+package chowder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func (c testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return testCert{cert: cert, key: key}
+}
+
+func newTestCA(t *testing.T) testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestClientCert(t *testing.T, ca testCert, cn string, uris ...string) testCert {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		assert.Nil(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+	return newTestCert(t, template, &ca)
+}
+
+func TestCertAuthMapsIdentities(t *testing.T) {
+	ca := newTestCA(t)
+	mapped := newTestClientCert(t, ca, "batch", "spiffe://cluster.local/ns/jobs/sa/batch")
+	byCN := newTestClientCert(t, ca, "interactive")
+	unmapped := newTestClientCert(t, ca, "stranger")
+
+	sut := NewCertAuth(map[string]CertUser{
+		"spiffe://cluster.local/ns/jobs/sa/batch": {User: "batch-job", Roles: []string{"scanner"}},
+		"interactive": {User: "uploads"},
+	})
+
+	id, ok := sut.Identify(mapped.cert)
+	assert.True(t, ok)
+	assert.Equal(t, &Identity{User: "batch-job", Method: "cert", Roles: []string{"scanner"}}, id)
+	id, ok = sut.Identify(byCN.cert)
+	assert.True(t, ok)
+	assert.Equal(t, "uploads", id.User)
+	_, ok = sut.Identify(unmapped.cert)
+	assert.False(t, ok)
+
+	id, ok = NewCertAuth(nil).Identify(mapped.cert)
+	assert.True(t, ok)
+	assert.Equal(t, "spiffe://cluster.local/ns/jobs/sa/batch", id.User)
+}
+
+func TestHeaderAuthAcceptsClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, &ca)
+	client := newTestClientCert(t, ca, "interactive")
+	stranger := newTestClientCert(t, ca, "stranger")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	users, _ := NewUsers(map[string]UserEntry{"password": {User: "token-user"}})
+	opts := AuthOptions{Certificates: NewCertAuth(map[string]CertUser{"interactive": {User: "uploads"}})}
+	var seen string
+	srv := httptest.NewUnstartedServer(HeaderAuth(users, opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = getIdentity(r.Context()).Method + ":" + getUser(r.Context())
+	})))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	get := func(cert *testCert, token string) int {
+		cfg := &tls.Config{RootCAs: pool}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{cert.tlsCertificate()}
+		}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get(&client, ""))
+	assert.Equal(t, "cert:uploads", seen)
+	assert.Equal(t, http.StatusUnauthorized, get(&stranger, ""))
+	assert.Equal(t, http.StatusOK, get(&stranger, "password"))
+	assert.Equal(t, "token:token-user", seen)
+	assert.Equal(t, http.StatusUnauthorized, get(nil, ""))
+}
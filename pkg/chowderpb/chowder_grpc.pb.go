@@ -0,0 +1,185 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: chowder/v1/chowder.proto
+
+package chowderpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Scanner_Scan_FullMethodName    = "/chowder.v1.Scanner/Scan"
+	Scanner_Version_FullMethodName = "/chowder.v1.Scanner/Version"
+)
+
+// ScannerClient is the client API for Scanner service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ScannerClient interface {
+	// Scan streams the content in chunks, returning the verdict once the stream is closed
+	Scan(ctx context.Context, opts ...grpc.CallOption) (Scanner_ScanClient, error)
+	// Version reports the versions of chowder and its antivirus
+	Version(ctx context.Context, in *VersionRequest, opts ...grpc.CallOption) (*VersionResponse, error)
+}
+
+type scannerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewScannerClient(cc grpc.ClientConnInterface) ScannerClient {
+	return &scannerClient{cc}
+}
+
+func (c *scannerClient) Scan(ctx context.Context, opts ...grpc.CallOption) (Scanner_ScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Scanner_ServiceDesc.Streams[0], Scanner_Scan_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &scannerScanClient{stream}
+	return x, nil
+}
+
+type Scanner_ScanClient interface {
+	Send(*Chunk) error
+	CloseAndRecv() (*ScanResult, error)
+	grpc.ClientStream
+}
+
+type scannerScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *scannerScanClient) Send(m *Chunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *scannerScanClient) CloseAndRecv() (*ScanResult, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ScanResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *scannerClient) Version(ctx context.Context, in *VersionRequest, opts ...grpc.CallOption) (*VersionResponse, error) {
+	out := new(VersionResponse)
+	err := c.cc.Invoke(ctx, Scanner_Version_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ScannerServer is the server API for Scanner service.
+// All implementations must embed UnimplementedScannerServer
+// for forward compatibility
+type ScannerServer interface {
+	// Scan streams the content in chunks, returning the verdict once the stream is closed
+	Scan(Scanner_ScanServer) error
+	// Version reports the versions of chowder and its antivirus
+	Version(context.Context, *VersionRequest) (*VersionResponse, error)
+	mustEmbedUnimplementedScannerServer()
+}
+
+// UnimplementedScannerServer must be embedded to have forward compatible implementations.
+type UnimplementedScannerServer struct {
+}
+
+func (UnimplementedScannerServer) Scan(Scanner_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedScannerServer) Version(context.Context, *VersionRequest) (*VersionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Version not implemented")
+}
+func (UnimplementedScannerServer) mustEmbedUnimplementedScannerServer() {}
+
+// UnsafeScannerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ScannerServer will
+// result in compilation errors.
+type UnsafeScannerServer interface {
+	mustEmbedUnimplementedScannerServer()
+}
+
+func RegisterScannerServer(s grpc.ServiceRegistrar, srv ScannerServer) {
+	s.RegisterService(&Scanner_ServiceDesc, srv)
+}
+
+func _Scanner_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ScannerServer).Scan(&scannerScanServer{stream})
+}
+
+type Scanner_ScanServer interface {
+	SendAndClose(*ScanResult) error
+	Recv() (*Chunk, error)
+	grpc.ServerStream
+}
+
+type scannerScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *scannerScanServer) SendAndClose(m *ScanResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *scannerScanServer) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Scanner_Version_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VersionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerServer).Version(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scanner_Version_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerServer).Version(ctx, req.(*VersionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Scanner_ServiceDesc is the grpc.ServiceDesc for Scanner service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Scanner_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chowder.v1.Scanner",
+	HandlerType: (*ScannerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Version",
+			Handler:    _Scanner_Version_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Scanner_Scan_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "chowder/v1/chowder.proto",
+}
@@ -18,6 +18,7 @@ var (
 	errDeferNoResponse = errors.New("Response triggered defer without setting")
 	instream           = newCommand("INSTREAM")
 	ping               = newCommand("PING")
+	version            = newCommand("VERSION")
 	emptyChunk         = []byte{0, 0, 0, 0}
 	written            = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "chowder_written_bytes_total",
@@ -28,6 +29,7 @@ var (
 		Help: "The total number of bytes read from the antivirus",
 	})
 	_ VirusScanner = &ClamAV{}
+	_ Versioner    = &ClamAV{}
 )
 
 // VirusScanner is the interface for a virus scanning service
@@ -36,6 +38,11 @@ type VirusScanner interface {
 	Ok() (ok bool, msg string, err error)
 }
 
+// Versioner is implemented by virus scanning services that can report their version
+type Versioner interface {
+	Version() (string, error)
+}
+
 // ClamAV is a virus scanning service backed by a ClamAV tcp connection
 type ClamAV struct {
 	connectionString string
@@ -89,6 +96,16 @@ func (av *ClamAV) Scan(stream io.Reader) (bool, string, error) {
 	return strings.Contains(response, "FOUND"), response, nil
 }
 
+// Signature extracts the signature name from a clamd response, e.g. Eicar-Test-Signature from
+// `stream: Eicar-Test-Signature FOUND`
+func Signature(msg string) string {
+	msg = strings.TrimSpace(strings.Trim(msg, "\000"))
+	if i := strings.Index(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(msg, "FOUND"))
+}
+
 // Ok checks that the backing ClamAV Antivirus is healthy
 func (av *ClamAV) Ok() (bool, string, error) {
 	log.Debug().Msg("pinging daemon")
@@ -99,6 +116,12 @@ func (av *ClamAV) Ok() (bool, string, error) {
 	return strings.Contains(response, "PONG"), response, nil
 }
 
+// Version returns the backing ClamAV Antivirus version and signature database version
+func (av *ClamAV) Version() (string, error) {
+	log.Debug().Msg("requesting daemon version")
+	return av.executeCommand(version, nil)
+}
+
 func (av *ClamAV) executeCommand(command clamCommand, additionalActions func(io.Writer) error) (string, error) {
 	c, err := av.dial()
 	if err != nil {
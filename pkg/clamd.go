@@ -0,0 +1,250 @@
+package chowder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxClamdCommand bounds a command line, the longest supported being IDSESSION
+	maxClamdCommand = 64
+	// clamdDrainLimit is how much of an unread stream is discarded to keep a session open after a rejection
+	clamdDrainLimit = 64 * 1024
+)
+
+var clamdCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chowder_clamd_commands_total",
+	Help: "The total number of clamd protocol commands received by command",
+}, []string{"command"})
+
+// ClamdServer speaks the clamd TCP protocol (PING, VERSION, INSTREAM and IDSESSION/END, in the z, n and
+// bare forms) so that tools written for clamd, e.g. mail filters or clamdscan --stream, can point at chowder
+// unchanged. Streams are handed to Handler as POST /scan requests, giving them the same limits, quotas,
+// metrics, logs and audit trail as the HTTP API.
+type ClamdServer struct {
+	Handler http.Handler
+	// Token authenticates the scans, as clamd clients cannot send credentials
+	Token string
+	// IdleTimeout closes connections waiting longer than this for a command, 0 never does
+	IdleTimeout time.Duration
+	connServer
+}
+
+// ListenAndServe listens on the TCP address and serves the clamd protocol until Shutdown or Close
+func (s *ClamdServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve answers clamd connections accepted from l, returning nil once the server is shut down
+func (s *ClamdServer) Serve(l net.Listener) error {
+	return s.serve(l, s.serveConn)
+}
+
+func (s *ClamdServer) serveConn(c net.Conn) {
+	defer s.untrack(c)
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	session, id := false, 0
+	for {
+		if s.IdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		cmd, delim, err := readClamdCommand(br)
+		if err != nil {
+			if err != io.EOF && !s.closed() {
+				log.Debug().Err(err).Str("remote-address", c.RemoteAddr().String()).Msg("malformed clamd command")
+			}
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if !s.track(c, true) {
+			return
+		}
+		clamdCommands.WithLabelValues(clamdCommandLabel(cmd)).Inc()
+		if cmd == "IDSESSION" && !session {
+			session = true
+			if !s.track(c, false) {
+				return
+			}
+			continue
+		}
+		if cmd == "END" && session {
+			return
+		}
+		reply, ok := s.command(c, br, cmd)
+		if session {
+			id++
+			reply = fmt.Sprintf("%d: %v", id, reply)
+		}
+		bw.WriteString(reply)
+		bw.WriteByte(delim)
+		// outside a session clamd answers one command per connection
+		if err = bw.Flush(); err != nil || !ok || !session {
+			return
+		}
+		if !s.track(c, false) {
+			return
+		}
+	}
+}
+
+// readClamdCommand reads a zCOMMAND\0, nCOMMAND\n or bare COMMAND\n, returning the delimiter replies end with
+func readClamdCommand(br *bufio.Reader) (string, byte, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return "", 0, err
+	}
+	delim := byte('\n')
+	switch first {
+	case 'z':
+		delim = 0
+	case 'n':
+	default:
+		br.UnreadByte()
+	}
+	var cmd []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", 0, err
+		}
+		if b == delim {
+			break
+		}
+		if len(cmd) >= maxClamdCommand {
+			return "", 0, fmt.Errorf("command longer than %v bytes", maxClamdCommand)
+		}
+		cmd = append(cmd, b)
+	}
+	return strings.TrimSpace(string(cmd)), delim, nil
+}
+
+// clamdCommandLabel keeps the metric's cardinality bounded whatever clients send
+func clamdCommandLabel(cmd string) string {
+	switch cmd {
+	case "PING", "VERSION", "INSTREAM", "IDSESSION", "END":
+		return cmd
+	}
+	return "unknown"
+}
+
+// command answers cmd, reporting whether the connection is still in step with the client
+func (s *ClamdServer) command(c net.Conn, br *bufio.Reader, cmd string) (string, bool) {
+	switch cmd {
+	case "PING":
+		return "PONG", true
+	case "VERSION":
+		rec := s.request(c, http.MethodGet, "/version", http.NoBody)
+		resp := &VersionResponse{}
+		if rec.status != http.StatusOK || json.Unmarshal(rec.body.Bytes(), resp) != nil {
+			return clamdError(rec), true
+		}
+		if resp.Antivirus == "" {
+			return "chowder " + resp.Version, true
+		}
+		return resp.Antivirus, true
+	case "INSTREAM":
+		stream := &clamdStream{r: br}
+		rec := s.request(c, http.MethodPost, "/scan", stream)
+		inStep := stream.discard()
+		resp := &ScanResponse{}
+		if rec.status != http.StatusOK || json.Unmarshal(rec.body.Bytes(), resp) != nil {
+			return clamdError(rec), inStep
+		}
+		if resp.Message == "" {
+			resp.Message = "stream: OK"
+			if resp.Infected {
+				resp.Message = "stream: UNKNOWN FOUND"
+			}
+		}
+		return resp.Message, inStep
+	}
+	return "UNKNOWN COMMAND", true
+}
+
+// request hands the command to the Handler as an HTTP request authenticated with the Token
+func (s *ClamdServer) request(c net.Conn, method, path string, body io.Reader) *responseRecorder {
+	r, err := http.NewRequest(method, path, ioutil.NopCloser(body))
+	if err != nil {
+		return &responseRecorder{status: http.StatusInternalServerError}
+	}
+	r.Proto = "clamd"
+	r.RemoteAddr = c.RemoteAddr().String()
+	r.ContentLength = -1
+	if s.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	return serveRecorded(s.Handler, r)
+}
+
+// clamdError formats a failed request the way clamd reports errors
+func clamdError(rec *responseRecorder) string {
+	resp := &Response{}
+	json.Unmarshal(rec.body.Bytes(), resp)
+	msg := resp.Error
+	if resp.Message != "" {
+		msg = resp.Message
+	}
+	if msg == "" {
+		msg = http.StatusText(rec.status)
+	}
+	return msg + " ERROR"
+}
+
+// clamdStream reads the data of an INSTREAM, sent as chunks prefixed with their big endian length and
+// ended by an empty chunk
+type clamdStream struct {
+	r         *bufio.Reader
+	remaining uint32
+	eof       bool
+}
+
+func (s *clamdStream) Read(p []byte) (int, error) {
+	for s.remaining == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(s.r, size[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		s.remaining = binary.BigEndian.Uint32(size[:])
+		if s.remaining == 0 {
+			s.eof = true
+		}
+	}
+	if uint32(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// discard reads what is left of the stream, reporting whether the connection is still usable
+func (s *clamdStream) discard() bool {
+	_, err := io.Copy(ioutil.Discard, io.LimitReader(s, clamdDrainLimit))
+	return err == nil && s.eof
+}
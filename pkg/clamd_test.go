@@ -0,0 +1,111 @@
+package chowder
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// clamdServer starts a ClamdServer in front of the scan and version routes, returning its address
+func clamdServer(t *testing.T, users map[string]UserEntry, token string) (addr string, stop func()) {
+	auth, err := NewUsers(users)
+	assert.Nil(t, err)
+	p := &Proxy{AntiVirus: contentScanner{}}
+	r := httprouter.New()
+	r.POST("/scan", RequireRole(RoleScanner, p.Scan))
+	r.GET("/version", p.Version)
+	sut := &ClamdServer{Handler: LogRequests(zerolog.Nop(), HeaderAuth(auth, AuthOptions{}, r)), Token: token}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- sut.Serve(l)
+	}()
+	return l.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Nil(t, sut.Shutdown(ctx))
+		assert.Nil(t, <-served)
+	}
+}
+
+func instreamChunks(chunks ...string) string {
+	var b strings.Builder
+	for _, c := range chunks {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(c)))
+		b.Write(size[:])
+		b.WriteString(c)
+	}
+	b.Write([]byte{0, 0, 0, 0})
+	return b.String()
+}
+
+// clamdConversation sends commands and returns everything the server wrote before closing the connection
+func clamdConversation(t *testing.T, addr, commands string) string {
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte(commands))
+	assert.Nil(t, err)
+	assert.Nil(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	b, err := ioutil.ReadAll(c)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestClamdServerAnswersCommands(t *testing.T) {
+	addr, stop := clamdServer(t, nil, "")
+	defer stop()
+
+	assert.Equal(t, "PONG\000", clamdConversation(t, addr, "zPING\000"))
+	assert.Equal(t, "ClamAV 1.0.0/27000\n", clamdConversation(t, addr, "nVERSION\n"))
+	assert.Equal(t, "PONG\n", clamdConversation(t, addr, "PING\n"))
+	assert.Equal(t, "UNKNOWN COMMAND\000", clamdConversation(t, addr, "zSHUTDOWN\000"))
+	assert.Equal(t, "stream: Eicar-Test-Signature FOUND\000", clamdConversation(t, addr, "zINSTREAM\000"+instreamChunks("X5O ", "EICAR")))
+}
+
+func TestClamdServerSessions(t *testing.T) {
+	addr, stop := clamdServer(t, nil, "")
+	defer stop()
+
+	got := clamdConversation(t, addr, "zIDSESSION\000zPING\000zINSTREAM\000"+instreamChunks("hello")+"zINSTREAM\000"+instreamChunks("EICAR")+"zEND\000")
+
+	assert.Equal(t, "1: PONG\0002: stream: OK\0003: stream: Eicar-Test-Signature FOUND\000", got)
+}
+
+func TestClamdServerAuthenticatesWithToken(t *testing.T) {
+	users := map[string]UserEntry{"token": {User: "mailfilter"}}
+	addr, stop := clamdServer(t, users, "")
+	defer stop()
+	assert.Equal(t, "no authorisation token supplied ERROR\000", clamdConversation(t, addr, "zINSTREAM\000"+instreamChunks("hello")))
+
+	addr, stop = clamdServer(t, users, "token")
+	defer stop()
+	assert.Equal(t, "stream: OK\000", clamdConversation(t, addr, "zINSTREAM\000"+instreamChunks("hello")))
+}
+
+func TestClamAVTalksToClamdServer(t *testing.T) {
+	addr, stop := clamdServer(t, nil, "")
+	defer stop()
+	sut := NewClamAV(addr)
+
+	ok, msg, err := sut.Ok()
+	assert.Nil(t, err)
+	assert.True(t, ok, msg)
+	infected, msg, err := sut.Scan(strings.NewReader("an EICAR test"))
+	assert.Nil(t, err)
+	assert.True(t, infected)
+	assert.Equal(t, "Eicar-Test-Signature", Signature(msg))
+	version, err := sut.(Versioner).Version()
+	assert.Nil(t, err)
+	assert.Equal(t, "ClamAV 1.0.0/27000", version)
+}
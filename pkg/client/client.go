@@ -0,0 +1,309 @@
+// Package client calls a chowder server's HTTP API
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetries is how many times a request answered 429 or 503 is retried
+	DefaultRetries = 3
+	// DefaultMaxRetryWait is the longest Retry-After a request waits out, longer waits (e.g. a used up
+	// monthly quota) return the error straight away
+	DefaultMaxRetryWait = 30 * time.Second
+	// maxResponseSize bounds the responses read, chowder's are all small JSON objects
+	maxResponseSize = 1 << 20
+)
+
+var (
+	// ErrUnauthorized is wrapped by errors for requests without a recognised token
+	ErrUnauthorized = errors.New("chowder: unauthorized")
+	// ErrForbidden is wrapped by errors for requests the user's roles do not allow
+	ErrForbidden = errors.New("chowder: forbidden")
+	// ErrLimited is wrapped by errors for requests over the user's rate limits or quotas
+	ErrLimited = errors.New("chowder: limited")
+	// ErrUnavailable is wrapped by errors for requests chowder is too busy for or while it is draining
+	ErrUnavailable = errors.New("chowder: unavailable")
+	// ErrScanFailed is wrapped by errors for scans the antivirus failed to complete
+	ErrScanFailed = errors.New("chowder: scan failed")
+)
+
+// Error is chowder's response to a request that did not succeed
+type Error struct {
+	StatusCode int
+	Message    string
+	Detail     string
+	// RetryAfter is how long chowder asked the client to wait before trying again, -1 if it did not say
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("chowder: %d %v", e.StatusCode, http.StatusText(e.StatusCode))
+	for _, s := range []string{e.Message, e.Detail} {
+		if s != "" {
+			msg += ": " + s
+		}
+	}
+	return msg
+}
+
+// Unwrap returns the sentinel error matching the status code, so callers can use errors.Is
+func (e *Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusTooManyRequests:
+		return ErrLimited
+	case http.StatusServiceUnavailable:
+		return ErrUnavailable
+	case http.StatusInternalServerError:
+		return ErrScanFailed
+	}
+	return nil
+}
+
+// Client calls a chowder server
+type Client struct {
+	base         *url.URL
+	http         *http.Client
+	token        string
+	retries      int
+	maxRetryWait time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken authenticates requests with `Authorization: Bearer <token>`
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient sends requests with hc, e.g. for client certificates or timeouts
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithRetries retries requests answered 429 or 503 up to retries times, waiting out Retry-After
+// when it is no longer than maxWait
+func WithRetries(retries int, maxWait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.maxRetryWait = maxWait
+	}
+}
+
+// New returns a Client for the chowder server at baseURL, e.g. https://chowder:3399
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chowder url: %v", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("chowder url '%v' must be http or https", baseURL)
+	}
+	c := &Client{base: base, http: http.DefaultClient, retries: DefaultRetries, maxRetryWait: DefaultMaxRetryWait}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// ScanOptions adjusts a scan
+type ScanOptions struct {
+	// Priority is sent as X-Chowder-Priority (high, normal or low), honoured for the server's priority roles
+	Priority string
+}
+
+// ScanResult is the verdict on scanned content
+type ScanResult struct {
+	Infected bool
+	// Signature names what was found, empty when clean
+	Signature string
+	// Message is the antivirus response
+	Message string
+}
+
+// Scan streams r to chowder and returns the verdict. Requests answered 429 or 503 are only retried when r
+// is an io.Seeker (e.g. an *os.File) that can be rewound to send again.
+func (c *Client) Scan(ctx context.Context, r io.Reader, opts *ScanOptions) (*ScanResult, error) {
+	seeker, _ := r.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+	header := http.Header{}
+	if opts != nil && opts.Priority != "" {
+		header.Set("X-Chowder-Priority", opts.Priority)
+	}
+	var resp struct {
+		Infected bool   `json:"infected"`
+		Message  string `json:"message"`
+	}
+	err := c.do(ctx, http.MethodPost, "/scan", header, func() (io.Reader, bool) {
+		if seeker == nil {
+			return r, false
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return r, false
+		}
+		return r, true
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	result := &ScanResult{Infected: resp.Infected, Message: resp.Message}
+	if resp.Infected {
+		result.Signature = signature(resp.Message)
+	}
+	return result, nil
+}
+
+// Version reports the versions of chowder and its antivirus
+type Version struct {
+	Version string `json:"version"`
+	// Antivirus is empty if chowder could not reach the antivirus
+	Antivirus string `json:"antivirus"`
+}
+
+// Version returns the versions of chowder and its antivirus
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	v := &Version{}
+	if err := c.do(ctx, http.MethodGet, "/version", nil, nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Live returns nil if chowder itself is serving requests
+func (c *Client) Live(ctx context.Context) error {
+	return c.probe(ctx, "/livez")
+}
+
+// Ready returns nil if chowder and its antivirus are ready to scan, otherwise an *Error
+// wrapping ErrUnavailable while draining or ErrScanFailed while the antivirus is down
+func (c *Client) Ready(ctx context.Context) error {
+	return c.probe(ctx, "/readyz")
+}
+
+// probe is not retried, a failing probe is an answer in itself
+func (c *Client) probe(ctx context.Context, path string) error {
+	req, err := c.request(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(req, nil)
+	return err
+}
+
+// do sends a request, retrying those answered 429 or 503 while body (nil for none) can be replayed
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body func() (io.Reader, bool), into interface{}) error {
+	for attempt := 0; ; attempt++ {
+		var r io.Reader
+		replayable := true
+		if body != nil {
+			r, replayable = body()
+		}
+		req, err := c.request(ctx, method, path, header, r)
+		if err != nil {
+			return err
+		}
+		retry, err := c.send(req, into)
+		if err == nil || retry < 0 || !replayable || attempt >= c.retries || retry > c.maxRetryWait {
+			return err
+		}
+		t := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) request(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Request, error) {
+	u := *c.base
+	u.Path += path
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("User-Agent", "chowder-client")
+	return req, nil
+}
+
+// send sends req, decoding a successful response into into. It returns how long to wait before
+// retrying a failure that may be retried, or -1 for one that may not.
+func (c *Client) send(req *http.Request, into interface{}) (time.Duration, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return -1, fmt.Errorf("could not read response: %v", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		if into == nil {
+			return -1, nil
+		}
+		if err = json.Unmarshal(b, into); err != nil {
+			return -1, fmt.Errorf("could not decode response: %v", err)
+		}
+		return -1, nil
+	}
+	var body struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		body.Error = strings.TrimSpace(string(b))
+	}
+	e := &Error{StatusCode: resp.StatusCode, Message: body.Message, Detail: body.Error, RetryAfter: -1}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return -1, e
+	}
+	if e.RetryAfter < 0 {
+		return time.Second, e
+	}
+	return e.RetryAfter, e
+}
+
+// signature extracts the signature name from a clamd response, e.g. Eicar-Test-Signature from
+// `stream: Eicar-Test-Signature FOUND`
+func signature(msg string) string {
+	if i := strings.Index(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(msg), "FOUND"))
+}
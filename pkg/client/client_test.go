@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	chowder "github.com/lachlanmunro/chowder/pkg"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// eicarScanner flags content containing EICAR as infected
+type eicarScanner struct{}
+
+func (eicarScanner) Scan(stream io.Reader) (bool, string, error) {
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return false, "", err
+	}
+	if bytes.Contains(b, []byte("EICAR")) {
+		return true, "stream: Eicar-Test-Signature FOUND", nil
+	}
+	return false, "stream: OK", nil
+}
+
+func (eicarScanner) Ok() (bool, string, error) {
+	return true, "PONG", nil
+}
+
+func (eicarScanner) Version() (string, error) {
+	return "ClamAV 1.0.0/27000", nil
+}
+
+// chowderServer serves the real Proxy routes behind token authentication, with wrap (if set) in front
+func chowderServer(t *testing.T, p *chowder.Proxy, wrap func(http.Handler) http.Handler) *httptest.Server {
+	users, err := chowder.NewUsers(map[string]chowder.UserEntry{
+		"scanner-token": {User: "scanner"},
+		"reader-token":  {User: "grafana", Roles: []string{chowder.RoleReader}},
+	})
+	assert.Nil(t, err)
+	r := httprouter.New()
+	r.POST("/scan", chowder.RequireRole(chowder.RoleScanner, p.Scan))
+	r.GET("/version", p.Version)
+	r.GET("/livez", p.Live)
+	r.GET("/readyz", p.Ready)
+	var h http.Handler = chowder.LogRequests(zerolog.Nop(), chowder.HeaderAuth(users, chowder.AuthOptions{PublicPaths: []string{"/livez", "/readyz"}}, r))
+	if wrap != nil {
+		h = wrap(h)
+	}
+	return httptest.NewServer(h)
+}
+
+func TestClientScans(t *testing.T) {
+	ts := chowderServer(t, &chowder.Proxy{AntiVirus: eicarScanner{}}, nil)
+	defer ts.Close()
+	sut, err := New(ts.URL, WithToken("scanner-token"))
+	assert.Nil(t, err)
+
+	result, err := sut.Scan(context.Background(), strings.NewReader("hello"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &ScanResult{Message: "stream: OK"}, result)
+
+	result, err = sut.Scan(context.Background(), strings.NewReader("an EICAR test"), &ScanOptions{Priority: "low"})
+	assert.Nil(t, err)
+	assert.Equal(t, &ScanResult{Infected: true, Signature: "Eicar-Test-Signature", Message: "stream: Eicar-Test-Signature FOUND"}, result)
+
+	version, err := sut.Version(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "ClamAV 1.0.0/27000", version.Antivirus)
+	assert.Nil(t, sut.Live(context.Background()))
+	assert.Nil(t, sut.Ready(context.Background()))
+}
+
+func TestClientReturnsTypedErrors(t *testing.T) {
+	p := &chowder.Proxy{AntiVirus: eicarScanner{}}
+	ts := chowderServer(t, p, nil)
+	defer ts.Close()
+
+	anonymous, err := New(ts.URL)
+	assert.Nil(t, err)
+	_, err = anonymous.Scan(context.Background(), strings.NewReader("hello"), nil)
+	assert.True(t, errors.Is(err, ErrUnauthorized), err)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "no authorisation token supplied", e.Message)
+
+	reader, err := New(ts.URL, WithToken("reader-token"))
+	assert.Nil(t, err)
+	_, err = reader.Scan(context.Background(), strings.NewReader("hello"), nil)
+	assert.True(t, errors.Is(err, ErrForbidden), err)
+
+	p.Drain()
+	assert.True(t, errors.Is(anonymous.Ready(context.Background()), ErrUnavailable))
+	assert.Nil(t, anonymous.Live(context.Background()))
+}
+
+func TestClientRetriesRewindableScans(t *testing.T) {
+	var requests int32
+	// the first request is turned away as if chowder were overloaded
+	overloadOnce := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				ioutil.ReadAll(r.Body)
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error":"Service Unavailable","message":"overloaded"}`))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	ts := chowderServer(t, &chowder.Proxy{AntiVirus: eicarScanner{}}, overloadOnce)
+	defer ts.Close()
+	sut, err := New(ts.URL, WithToken("scanner-token"))
+	assert.Nil(t, err)
+
+	result, err := sut.Scan(context.Background(), bytes.NewReader([]byte("an EICAR test")), nil)
+	assert.Nil(t, err)
+	assert.True(t, result.Infected)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// a plain io.Reader cannot be sent again
+	atomic.StoreInt32(&requests, 0)
+	_, err = sut.Scan(context.Background(), ioutil.NopCloser(strings.NewReader("hello")), nil)
+	assert.True(t, errors.Is(err, ErrUnavailable), err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestClientDoesNotWaitOutLongRetryAfters(t *testing.T) {
+	p := &chowder.Proxy{AntiVirus: eicarScanner{}, Admission: chowder.NewAdmission(1, 0, time.Minute)}
+	release, err := p.Admission.Acquire(context.Background())
+	assert.Nil(t, err)
+	defer release()
+	ts := chowderServer(t, p, nil)
+	defer ts.Close()
+	sut, err := New(ts.URL, WithToken("scanner-token"), WithRetries(3, time.Second))
+	assert.Nil(t, err)
+
+	_, err = sut.Scan(context.Background(), bytes.NewReader([]byte("hello")), nil)
+
+	var e *Error
+	assert.True(t, errors.As(err, &e), err)
+	assert.Equal(t, http.StatusServiceUnavailable, e.StatusCode)
+	assert.Equal(t, time.Minute, e.RetryAfter)
+}
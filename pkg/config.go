@@ -0,0 +1,126 @@
+package chowder
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadConfig completes fs, which has already parsed the command line, from environment variables (prefix
+// followed by the upper cased flag name, e.g. CHOWDER_SCANSLOTS) and then from the yaml file named by the
+// configFlag flag, keyed by flag name. Flags take precedence over the environment, which takes precedence
+// over the file. Every invalid or unknown setting is reported in the returned error.
+func LoadConfig(fs *flag.FlagSet, configFlag, prefix string, lookupEnv func(string) (string, bool)) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var problems []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		name := prefix + strings.ToUpper(f.Name)
+		if v, ok := lookupEnv(name); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: invalid value %q: %v", name, v, err))
+			}
+			set[f.Name] = true
+		}
+	})
+	if f := fs.Lookup(configFlag); f != nil && f.Value.String() != "" {
+		problems = append(problems, applyConfigFile(fs, f.Value.String(), configFlag, set)...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func applyConfigFile(fs *flag.FlagSet, path, configFlag string, set map[string]bool) []string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []string{fmt.Sprintf("could not read config file: %v", err)}
+	}
+	settings := make(map[string]interface{})
+	if err = yaml.Unmarshal(b, &settings); err != nil {
+		return []string{fmt.Sprintf("could not parse config file %v: %v", path, err)}
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == configFlag {
+			problems = append(problems, fmt.Sprintf("%v: unknown setting '%v'", path, name))
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		v, err := configValue(settings[name])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v %v", path, name, err))
+		} else if err = fs.Set(name, v); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v has invalid value %q: %v", path, name, v, err))
+		}
+	}
+	return problems
+}
+
+// configValue converts a yaml value to its flag form, lists becoming comma separated
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a value or a list, not %T", v)
+}
+
+// WriteConfig writes the effective value of every flag in fs as a yaml config file, each preceded by its
+// usage as a comment, skipping the named flags
+func WriteConfig(w io.Writer, fs *flag.FlagSet, skip ...string) error {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || skipped[f.Name] {
+			return
+		}
+		value := f.Value.String()
+		if g, ok := f.Value.(flag.Getter); ok {
+			switch g.Get().(type) {
+			case string, time.Duration:
+				var b []byte
+				if b, err = yaml.Marshal(value); err != nil {
+					return
+				}
+				value = strings.TrimSpace(string(b))
+			}
+		}
+		_, err = fmt.Fprintf(w, "# %v\n%v: %v\n", strings.Replace(f.Usage, "\n", " ", -1), f.Name, value)
+	})
+	return err
+}
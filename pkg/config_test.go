@@ -0,0 +1,84 @@
+package chowder
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupConfigTest(t *testing.T, file string) (fs *flag.FlagSet, slots *int, roles *string, wait *time.Duration) {
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	path := ""
+	if file != "" {
+		dir, err := ioutil.TempDir("", "chowder-config")
+		assert.Nil(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		path = filepath.Join(dir, "chowder.yml")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(file), 0600))
+	}
+	fs.String("config", path, "Config file")
+	slots = fs.Int("scanslots", 0, "Scan slots")
+	roles = fs.String("priorityroles", "admin", "Priority roles")
+	wait = fs.Duration("scanqueuetimeout", time.Second, "Queue timeout")
+	return
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	fs, slots, roles, wait := setupConfigTest(t, "scanslots: 4\npriorityroles: [admin, scanner]\nscanqueuetimeout: 5s\n")
+	assert.Nil(t, fs.Parse([]string{"-scanslots", "2"}))
+
+	err := LoadConfig(fs, "config", "CHOWDER_", env(map[string]string{"CHOWDER_SCANQUEUETIMEOUT": "1m", "CHOWDER_SCANSLOTS": "3"}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, *slots)
+	assert.Equal(t, "admin,scanner", *roles)
+	assert.Equal(t, time.Minute, *wait)
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	fs, _, _, _ := setupConfigTest(t, "scanslot: 4\nscanslots: many\npriorityroles: {a: b}\nconfig: other.yml\n")
+	assert.Nil(t, fs.Parse(nil))
+
+	err := LoadConfig(fs, "config", "CHOWDER_", env(map[string]string{"CHOWDER_SCANQUEUETIMEOUT": "soon"}))
+
+	assert.NotNil(t, err)
+	for _, problem := range []string{
+		`CHOWDER_SCANQUEUETIMEOUT: invalid value "soon"`,
+		"unknown setting 'config'",
+		"unknown setting 'scanslot'",
+		"priorityroles must be a value or a list",
+		`scanslots has invalid value "many"`,
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestWriteConfigRoundTrips(t *testing.T) {
+	fs, slots, roles, wait := setupConfigTest(t, "")
+	assert.Nil(t, fs.Parse([]string{"-scanslots", "7", "-priorityroles", "admin: yes", "-scanqueuetimeout", "90s"}))
+	out := &strings.Builder{}
+
+	assert.Nil(t, WriteConfig(out, fs, "config"))
+
+	assert.Equal(t, "# Priority roles\npriorityroles: 'admin: yes'\n# Queue timeout\nscanqueuetimeout: 1m30s\n# Scan slots\nscanslots: 7\n", out.String())
+	reloaded, reSlots, reRoles, reWait := setupConfigTest(t, out.String())
+	assert.Nil(t, reloaded.Parse(nil))
+	assert.Nil(t, LoadConfig(reloaded, "config", "CHOWDER_", env(nil)))
+	assert.Equal(t, *slots, *reSlots)
+	assert.Equal(t, *roles, *reRoles)
+	assert.Equal(t, *wait, *reWait)
+}
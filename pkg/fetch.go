@@ -0,0 +1,368 @@
+package chowder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultFetchSize bounds the content fetched by URL if not set
+	DefaultFetchSize = 100 << 20
+	// DefaultFetchTimeout bounds fetching and scanning content by URL if not set
+	DefaultFetchTimeout = time.Minute
+	// maxScanURLBody bounds the json body of a POST /scan/url
+	maxScanURLBody = 64 * 1024
+)
+
+var (
+	fetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_url_fetches_total",
+		Help: "The total number of fetches for scans by URL by outcome",
+	}, []string{"outcome"})
+	// reservedNetworks are not reachable by URL unless allowed, as they are internal to the deployment or
+	// not routable on the internet
+	reservedNetworks = parseNetworks(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+		// NAT64 and 6to4 addresses embed IPv4 ones, which may be internal
+		"64:ff9b::/96", "64:ff9b:1::/48", "2002::/16",
+	)
+	errTooLarge = errors.New("url content is larger than the size limit")
+)
+
+// URLFetcher fetches content to be scanned by reference. It only fetches from the allowed schemes and
+// hosts, and refuses to connect to private, loopback and other reserved addresses (checked on every
+// connection, after DNS resolution and redirects) outside of the allowed networks.
+type URLFetcher struct {
+	// Schemes that may be fetched, https if empty
+	Schemes []string
+	// Hosts that may be fetched, e.g. artifacts.internal or *.example.com (any subdomain), or * for any
+	Hosts []string
+	// Networks that may be connected to even though they are reserved, e.g. 10.1.0.0/16 for an internal artifact server
+	Networks []*net.IPNet
+	// MaxSize bounds the content fetched, DefaultFetchSize if not positive
+	MaxSize int64
+	// Timeout bounds fetching and scanning the content, DefaultFetchTimeout if not positive
+	Timeout time.Duration
+	// MaxRedirects is how many redirects are followed, 0 follows none
+	MaxRedirects int
+	client       *http.Client
+	clientOnce   sync.Once
+}
+
+// NewURLFetcher returns a URLFetcher for the comma separated schemes and hosts, allowing the comma separated
+// networks (CIDRs) despite being reserved
+func NewURLFetcher(schemes, hosts, networks string, maxSize int64, timeout time.Duration, maxRedirects int) (*URLFetcher, error) {
+	f := &URLFetcher{Schemes: splitList(schemes), Hosts: splitList(hosts), MaxSize: maxSize, Timeout: timeout, MaxRedirects: maxRedirects}
+	for _, cidr := range splitList(networks) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%v': %v", cidr, err)
+		}
+		f.Networks = append(f.Networks, n)
+	}
+	return f, nil
+}
+
+// ScanURLRequest is the body of a POST /scan/url
+type ScanURLRequest struct {
+	URL string `json:"url"`
+}
+
+// FetchURL wraps POST /scan/url, checking the URL in the ScanURLRequest body and standing in a body that
+// ScanURL fills with the content once the scan is admitted. Applied outside the limits and quotas, they
+// meter the content as if it had been uploaded.
+func (p *Proxy) FetchURL(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if p.Fetcher == nil {
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusNotFound),
+				Message: "scanning by url is not enabled",
+			}, http.StatusNotFound)
+			return
+		}
+		req := &ScanURLRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxScanURLBody)).Decode(req); err != nil {
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusBadRequest),
+				Message: fmt.Sprintf("could not decode request: %v", err),
+			}, http.StatusBadRequest)
+			return
+		}
+		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+			return l.Str("url", req.URL)
+		})
+		u, err := p.Fetcher.check(req.URL)
+		if err != nil {
+			fetches.WithLabelValues("refused").Inc()
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(err.status),
+				Message: err.msg,
+			}, err.status)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), p.Fetcher.timeout())
+		defer cancel()
+		body := &urlBody{url: u}
+		r = r.WithContext(context.WithValue(ctx, urlBodyKey, body))
+		r.Body = body
+		r.ContentLength = -1
+		handle(w, r, ps)
+	}
+}
+
+// ScanURL fetches the URL checked by FetchURL and streams it to the antivirus
+func (p *Proxy) ScanURL(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Debug().Msg("received scan url request")
+	body, ok := r.Context().Value(urlBodyKey).(*urlBody)
+	if !ok || p.Fetcher == nil {
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusInternalServerError),
+			Message: "scan url route is not wrapped by FetchURL",
+		}, http.StatusInternalServerError)
+		return
+	}
+	infected, msg, scanned := p.scan(w, r, func() (io.ReadCloser, error) {
+		content, err := p.Fetcher.fetch(r.Context(), body.url)
+		if err != nil {
+			return nil, err
+		}
+		fetches.WithLabelValues("fetched").Inc()
+		body.content = content
+		// read through whatever wraps the body, e.g. to meter it
+		return r.Body, nil
+	})
+	if scanned {
+		writeScanResponse(w, r, infected, msg)
+	}
+}
+
+// urlBody stands in for the body of a POST /scan/url, reading the content at the URL once it is fetched
+type urlBody struct {
+	url *url.URL
+	lateBody
+}
+
+// lateBody reads content set once the scan is admitted, and nothing before
+type lateBody struct {
+	content io.ReadCloser
+}
+
+func (b *lateBody) Read(p []byte) (int, error) {
+	if b.content == nil {
+		return 0, io.EOF
+	}
+	return b.content.Read(p)
+}
+
+func (b *lateBody) Close() error {
+	if b.content == nil {
+		return nil
+	}
+	return b.content.Close()
+}
+
+// check parses raw, returning an error if it may not be fetched
+func (f *URLFetcher) check(raw string) (*url.URL, *httpError) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, &httpError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid url '%v'", raw)}
+	}
+	if !f.allowedScheme(u.Scheme) {
+		return nil, &httpError{status: http.StatusForbidden, msg: fmt.Sprintf("url scheme '%v' is not allowed", u.Scheme)}
+	}
+	if !f.allowedHost(u.Hostname()) {
+		return nil, &httpError{status: http.StatusForbidden, msg: fmt.Sprintf("url host '%v' is not allowed", u.Hostname())}
+	}
+	return u, nil
+}
+
+func (f *URLFetcher) allowedScheme(scheme string) bool {
+	schemes := f.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"https"}
+	}
+	for _, s := range schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *URLFetcher) allowedHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range f.Hosts {
+		h = strings.ToLower(h)
+		switch {
+		case h == "*" || h == host:
+			return true
+		case strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIP reports whether ip may be connected to
+func (f *URLFetcher) allowedIP(ip net.IP) bool {
+	for _, n := range f.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *URLFetcher) timeout() time.Duration {
+	if f.Timeout <= 0 {
+		return DefaultFetchTimeout
+	}
+	return f.Timeout
+}
+
+func (f *URLFetcher) maxSize() int64 {
+	if f.MaxSize <= 0 {
+		return DefaultFetchSize
+	}
+	return f.MaxSize
+}
+
+// fetch returns the body of a successful GET of u, which fails reads once it is larger than MaxSize
+func (f *URLFetcher) fetch(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid url: %v", err)}
+	}
+	req.Header.Set("User-Agent", "chowder")
+	resp, err := f.httpClient().Do(req)
+	if err != nil {
+		fetches.WithLabelValues("failed").Inc()
+		var refused *httpError
+		if errors.As(err, &refused) {
+			return nil, refused
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &httpError{status: http.StatusGatewayTimeout, msg: fmt.Sprintf("timed out fetching url after %v", f.timeout())}
+		}
+		return nil, &httpError{status: http.StatusBadGateway, msg: fmt.Sprintf("could not fetch url: %v", err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		fetches.WithLabelValues("failed").Inc()
+		return nil, &httpError{status: http.StatusBadGateway, msg: fmt.Sprintf("fetching url returned %v", resp.Status)}
+	}
+	if resp.ContentLength > f.maxSize() {
+		resp.Body.Close()
+		fetches.WithLabelValues("too_large").Inc()
+		return nil, &httpError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("url content is larger than %v bytes", f.maxSize())}
+	}
+	return &limitedBody{ReadCloser: resp.Body, remaining: f.maxSize()}, nil
+}
+
+// httpClient connects only to allowed addresses and follows only allowed redirects
+func (f *URLFetcher) httpClient() *http.Client {
+	f.clientOnce.Do(f.newClient)
+	return f.client
+}
+
+func (f *URLFetcher) newClient() {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// checked once the address is resolved, so a host cannot resolve to an internal address
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !f.allowedIP(ip) {
+				return &httpError{status: http.StatusForbidden, msg: fmt.Sprintf("url address %v is not allowed", host)}
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		// no proxy from the environment, as it would make the connections the dialer checks
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > f.MaxRedirects {
+				return &httpError{status: http.StatusBadGateway, msg: fmt.Sprintf("url redirected more than %v times", f.MaxRedirects)}
+			}
+			if _, err := f.check(req.URL.String()); err != nil {
+				return &httpError{status: err.status, msg: "redirected to a " + err.msg}
+			}
+			return nil
+		},
+	}
+}
+
+// limitedBody fails reads past its size limit, so that content too large is not scanned only in part
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errTooLarge
+	}
+	return n, err
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func splitList(list string) []string {
+	var split []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			split = append(split, s)
+		}
+	}
+	return split
+}
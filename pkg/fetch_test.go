@@ -0,0 +1,195 @@
+package chowder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// artifactServer serves files by path, redirecting /redirect/N N times before serving /eicar.com
+func artifactServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clean.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	mux.HandleFunc("/eicar.com", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "X5O EICAR")
+	})
+	mux.HandleFunc("/big.bin", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("a", 1000))
+	})
+	mux.HandleFunc("/streamed.bin", func(w http.ResponseWriter, r *http.Request) {
+		// flushed without a Content-Length, so the size is only known once read
+		for i := 0; i < 10; i++ {
+			fmt.Fprint(w, strings.Repeat("a", 100))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(r.URL.Path, "/redirect/%d", &n)
+		if n <= 1 {
+			http.Redirect(w, r, "/eicar.com", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	})
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://evil.example.com/eicar.com", http.StatusFound)
+	})
+	return httptest.NewServer(mux)
+}
+
+func scanURL(t *testing.T, f *URLFetcher, target string) (int, *ScanResponse) {
+	p := &Proxy{AntiVirus: contentScanner{}, Fetcher: f}
+	r := httprouter.New()
+	r.POST("/scan/url", p.FetchURL(p.ScanURL))
+	ts := httptest.NewServer(LogRequests(zerolog.Nop(), r))
+	defer ts.Close()
+	body, _ := json.Marshal(&ScanURLRequest{URL: target})
+	resp, err := http.Post(ts.URL+"/scan/url", "application/json", strings.NewReader(string(body)))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	got := &ScanResponse{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(got))
+	return resp.StatusCode, got
+}
+
+// localFetcher may fetch from the artifact server on loopback
+func localFetcher(t *testing.T) *URLFetcher {
+	f, err := NewURLFetcher("http", "127.0.0.1", "127.0.0.0/8", 500, time.Second, 2)
+	assert.Nil(t, err)
+	return f
+}
+
+func TestScanURLScansFetchedContent(t *testing.T) {
+	artifacts := artifactServer()
+	defer artifacts.Close()
+
+	status, resp := scanURL(t, localFetcher(t), artifacts.URL+"/clean.txt")
+	assert.Equal(t, http.StatusOK, status)
+	assert.False(t, resp.Infected)
+
+	status, resp = scanURL(t, localFetcher(t), artifacts.URL+"/eicar.com")
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, resp.Infected)
+	assert.Equal(t, "stream: Eicar-Test-Signature FOUND", resp.Message)
+}
+
+func TestScanURLRefusesDisallowedURLs(t *testing.T) {
+	artifacts := artifactServer()
+	defer artifacts.Close()
+	noNetworks, err := NewURLFetcher("http", "127.0.0.1,localhost", "", 0, time.Second, 0)
+	assert.Nil(t, err)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(artifacts.URL, "http://"))
+
+	for _, c := range []struct {
+		fetcher *URLFetcher
+		url     string
+		status  int
+		message string
+	}{
+		{localFetcher(t), "not a url", http.StatusBadRequest, "invalid url 'not a url'"},
+		{localFetcher(t), "ftp://127.0.0.1/eicar.com", http.StatusForbidden, "url scheme 'ftp' is not allowed"},
+		{localFetcher(t), "http://evil.example.com/eicar.com", http.StatusForbidden, "url host 'evil.example.com' is not allowed"},
+		// loopback is reserved, however the host is spelled
+		{noNetworks, artifacts.URL + "/eicar.com", http.StatusForbidden, "url address 127.0.0.1 is not allowed"},
+		{noNetworks, "http://localhost:" + port + "/eicar.com", http.StatusForbidden, "is not allowed"},
+		{localFetcher(t), artifacts.URL + "/elsewhere", http.StatusForbidden, "redirected to a url host 'evil.example.com' is not allowed"},
+	} {
+		status, resp := scanURL(t, c.fetcher, c.url)
+		assert.Equal(t, c.status, status, c.url)
+		assert.Contains(t, resp.Message, c.message, c.url)
+	}
+}
+
+func TestScanURLLimitsRedirectsSizeAndTime(t *testing.T) {
+	artifacts := artifactServer()
+	defer artifacts.Close()
+
+	status, resp := scanURL(t, localFetcher(t), artifacts.URL+"/redirect/2")
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, resp.Infected)
+
+	status, resp = scanURL(t, localFetcher(t), artifacts.URL+"/redirect/3")
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Contains(t, resp.Message, "url redirected more than 2 times")
+
+	status, resp = scanURL(t, localFetcher(t), artifacts.URL+"/big.bin")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "url content is larger than 500 bytes", resp.Message)
+
+	// content without a length is scanned until it is too large, failing the scan
+	status, resp = scanURL(t, localFetcher(t), artifacts.URL+"/streamed.bin")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Contains(t, resp.Error, "url content is larger than the size limit")
+
+	status, resp = scanURL(t, localFetcher(t), artifacts.URL+"/missing")
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, "fetching url returned 404 Not Found", resp.Message)
+
+	f := localFetcher(t)
+	f.Timeout = 50 * time.Millisecond
+	status, resp = scanURL(t, f, artifacts.URL+"/slow")
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+	assert.Equal(t, "timed out fetching url after 50ms", resp.Message)
+}
+
+func TestScanURLIsMeteredLikeAnUpload(t *testing.T) {
+	artifacts := artifactServer()
+	defer artifacts.Close()
+	users, err := NewUsers(map[string]UserEntry{"token": {User: "ci", Quota: &Quota{DailyBytes: 8}}})
+	assert.Nil(t, err)
+	usage, err := OpenUsageStore("", Quota{})
+	assert.Nil(t, err)
+	p := &Proxy{AntiVirus: contentScanner{}, Fetcher: localFetcher(t)}
+	r := httprouter.New()
+	r.POST("/scan/url", p.FetchURL(usage.Enforce(p.ScanURL)))
+	ts := httptest.NewServer(LogRequests(zerolog.Nop(), HeaderAuth(users, AuthOptions{}, r)))
+	defer ts.Close()
+	post := func() int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/scan/url", strings.NewReader(`{"url": "`+artifacts.URL+`/eicar.com"}`))
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post())
+	assert.Equal(t, int64(9), usage.Get("ci").Daily.Bytes)
+	assert.Equal(t, http.StatusTooManyRequests, post())
+}
+
+func TestURLFetcherAllowsHosts(t *testing.T) {
+	sut := &URLFetcher{Hosts: []string{"artifacts.internal", "*.example.com"}}
+
+	assert.True(t, sut.allowedHost("artifacts.internal"))
+	assert.True(t, sut.allowedHost("ARTIFACTS.internal."))
+	assert.True(t, sut.allowedHost("cdn.example.com"))
+	assert.False(t, sut.allowedHost("example.com.evil.net"))
+	assert.False(t, sut.allowedHost("notexample.com"))
+	assert.True(t, sut.allowedIP(net.ParseIP("93.184.216.34")))
+	assert.False(t, sut.allowedIP(net.ParseIP("169.254.169.254")))
+	assert.False(t, sut.allowedIP(net.ParseIP("::ffff:10.0.0.1")))
+	assert.False(t, sut.allowedIP(net.ParseIP("fd00::1")))
+	// NAT64 of 10.0.0.1 and 6to4 of 127.0.0.1
+	assert.False(t, sut.allowedIP(net.ParseIP("64:ff9b::a00:1")))
+	assert.False(t, sut.allowedIP(net.ParseIP("2002:7f00:1::1")))
+	assert.True(t, sut.allowedIP(net.ParseIP("2606:2800:220:1::1")))
+}
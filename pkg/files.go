@@ -0,0 +1,145 @@
+package chowder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileResult is the verdict on one scanned file
+type FileResult struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// Error is why the file could not be scanned, in which case it may or may not be infected
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+// FileScanner scans files and the trees under directories through a VirusScanner
+type FileScanner struct {
+	AntiVirus VirusScanner
+	// Concurrency is how many files are scanned at once, 1 if not positive
+	Concurrency int
+	// Include, if not empty, limits the files scanned to those matching one of its globs, e.g. *.jar
+	Include []string
+	// Exclude skips the files and directories matching one of its globs, e.g. node_modules or dist/*.map.
+	// Globs with a slash match paths relative to the directory walked, others match base names.
+	Exclude []string
+}
+
+// Scan scans the paths, walking directories recursively without following symlinks, and returns the
+// results sorted by path. Walking stops early if ctx is done, the files not yet scanned being left out.
+func (s *FileScanner) Scan(ctx context.Context, paths []string) []FileResult {
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	files := make(chan FileResult)
+	found := make(chan FileResult)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				found <- s.scanFile(f)
+			}
+		}()
+	}
+	go func() {
+		defer func() {
+			close(files)
+			wg.Wait()
+			close(found)
+		}()
+		for _, root := range paths {
+			s.walk(ctx, root, files, found)
+		}
+	}()
+	var results []FileResult
+	for r := range found {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	return results
+}
+
+// walk sends the files under root to be scanned, and the paths that could not be read straight to results
+func (s *FileScanner) walk(ctx context.Context, root string, files, results chan<- FileResult) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			results <- FileResult{Path: path, Error: err.Error()}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if path != root && matchesAny(s.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || (path != root && len(s.Include) > 0 && !matchesAny(s.Include, rel)) {
+			return nil
+		}
+		select {
+		case files <- FileResult{Path: path, Size: info.Size()}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+}
+
+func (s *FileScanner) scanFile(f FileResult) FileResult {
+	start := time.Now()
+	file, err := os.Open(f.Path)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	defer file.Close()
+	infected, msg, err := s.AntiVirus.Scan(file)
+	f.Duration = time.Since(start)
+	f.setVerdict(infected, msg, err)
+	return f
+}
+
+// setVerdict records the outcome of a VirusScanner scan
+func (f *FileResult) setVerdict(infected bool, msg string, err error) {
+	if err != nil {
+		f.Error = fmt.Sprintf("scan failed: %v", err)
+		return
+	}
+	f.Infected, f.Message = infected, strings.TrimSpace(strings.Trim(msg, "\000"))
+	if infected {
+		f.Signature = Signature(msg)
+	}
+}
+
+// matchesAny reports whether one of the globs matches the base name of rel or, for globs with a
+// slash, the whole of rel (the path relative to the directory walked)
+func matchesAny(globs []string, rel string) bool {
+	for _, g := range globs {
+		name := filepath.Base(rel)
+		if strings.Contains(g, "/") {
+			name = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
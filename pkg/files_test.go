@@ -0,0 +1,86 @@
+package chowder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingScanner fails every scan as if the antivirus were down
+type failingScanner struct{}
+
+func (failingScanner) Scan(stream io.Reader) (bool, string, error) {
+	return false, "", errors.New("connection refused")
+}
+
+func (failingScanner) Ok() (bool, string, error) {
+	return false, "", errors.New("connection refused")
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func resultPaths(dir string, results []FileResult) []string {
+	var paths []string
+	for _, r := range results {
+		rel, _ := filepath.Rel(dir, r.Path)
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	return paths
+}
+
+func TestFileScannerWalksDirectories(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.txt":              "hello",
+		"lib/b.jar":          "an EICAR test",
+		"lib/deep/c.txt":     "world",
+		"node_modules/d.txt": "ignored",
+	})
+	sut := &FileScanner{AntiVirus: contentScanner{}, Concurrency: 3}
+
+	results := sut.Scan(context.Background(), []string{dir})
+
+	assert.Equal(t, []string{"a.txt", "lib/b.jar", "lib/deep/c.txt", "node_modules/d.txt"}, resultPaths(dir, results))
+	assert.Equal(t, FileResult{Path: filepath.Join(dir, "lib", "b.jar"), Size: 13, Infected: true, Signature: "Eicar-Test-Signature",
+		Message: "stream: Eicar-Test-Signature FOUND", Duration: results[1].Duration}, results[1])
+	assert.False(t, results[0].Infected)
+	assert.Equal(t, "stream: OK", results[0].Message)
+}
+
+func TestFileScannerIncludesAndExcludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.txt":              "hello",
+		"b.jar":              "hello",
+		"lib/c.txt":          "hello",
+		"node_modules/d.txt": "hello",
+	})
+	sut := &FileScanner{AntiVirus: contentScanner{}, Include: []string{"*.txt"}, Exclude: []string{"node_modules", "lib/*.txt"}}
+
+	results := sut.Scan(context.Background(), []string{dir})
+
+	assert.Equal(t, []string{"a.txt"}, resultPaths(dir, results))
+}
+
+func TestFileScannerReportsErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.txt": "hello"})
+	sut := &FileScanner{AntiVirus: failingScanner{}}
+
+	results := sut.Scan(context.Background(), []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "missing")})
+
+	assert.Len(t, results, 2)
+	assert.Equal(t, "scan failed: connection refused", results[0].Error)
+	assert.Contains(t, results[1].Error, "no such file or directory")
+}
@@ -0,0 +1,236 @@
+package chowder
+
+//go:generate buf generate --template ../buf.gen.yaml -o .. ../proto
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lachlanmunro/chowder/pkg/chowderpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcService is the name the Scanner service answers health checks to, alongside the whole server's ""
+const grpcService = "chowder.v1.Scanner"
+
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:         codes.InvalidArgument,
+	http.StatusUnauthorized:       codes.Unauthenticated,
+	http.StatusForbidden:          codes.PermissionDenied,
+	http.StatusNotFound:           codes.Unimplemented,
+	http.StatusTooManyRequests:    codes.ResourceExhausted,
+	http.StatusServiceUnavailable: codes.Unavailable,
+}
+
+// GRPCScanner serves the chowder.v1.Scanner gRPC service. Calls are handed to Handler as the matching HTTP
+// request (POST /scan or GET /version) carrying the call's metadata as headers, so gRPC shares the HTTP
+// API's authentication, limits, quotas, metrics, logs and audit trail.
+type GRPCScanner struct {
+	chowderpb.UnimplementedScannerServer
+	Handler http.Handler
+}
+
+// NewGRPCServer returns a gRPC server serving the Scanner through handler and the standard gRPC health
+// service from p's readiness, which Watch polls every healthPoll
+func NewGRPCServer(handler http.Handler, p *Proxy, healthPoll time.Duration, opts ...grpc.ServerOption) *GRPCServer {
+	srv := &GRPCServer{Server: grpc.NewServer(opts...), health: &grpcHealth{proxy: p, poll: healthPoll, stop: make(chan struct{})}}
+	chowderpb.RegisterScannerServer(srv, &GRPCScanner{Handler: handler})
+	healthpb.RegisterHealthServer(srv, srv.health)
+	return srv
+}
+
+// Scan streams the chunks sent to the antivirus, answering once the client closes the stream
+func (s *GRPCScanner) Scan(stream chowderpb.Scanner_ScanServer) error {
+	rec := s.serve(stream.Context(), http.MethodPost, "/scan", &chunkReader{stream: stream})
+	if err := grpcError(stream.Context(), rec); err != nil {
+		return err
+	}
+	resp := &ScanResponse{}
+	if err := json.Unmarshal(rec.body.Bytes(), resp); err != nil {
+		return status.Errorf(codes.Internal, "could not read scan response: %v", err)
+	}
+	result := &chowderpb.ScanResult{Infected: resp.Infected, Message: resp.Message}
+	if resp.Infected {
+		result.Signature = Signature(resp.Message)
+	}
+	return stream.SendAndClose(result)
+}
+
+// Version reports the versions of chowder and its antivirus
+func (s *GRPCScanner) Version(ctx context.Context, _ *chowderpb.VersionRequest) (*chowderpb.VersionResponse, error) {
+	rec := s.serve(ctx, http.MethodGet, "/version", http.NoBody)
+	if err := grpcError(ctx, rec); err != nil {
+		return nil, err
+	}
+	resp := &VersionResponse{}
+	if err := json.Unmarshal(rec.body.Bytes(), resp); err != nil {
+		return nil, status.Errorf(codes.Internal, "could not read version response: %v", err)
+	}
+	return &chowderpb.VersionResponse{Version: resp.Version, Antivirus: resp.Antivirus}, nil
+}
+
+// serve hands the call to the Handler as an HTTP request carrying the call's metadata and peer
+func (s *GRPCScanner) serve(ctx context.Context, method, path string, body io.Reader) *responseRecorder {
+	r, err := http.NewRequestWithContext(ctx, method, path, body)
+	if err != nil {
+		return &responseRecorder{status: http.StatusInternalServerError}
+	}
+	if full, ok := grpc.Method(ctx); ok {
+		r.RequestURI = full
+	}
+	r.Proto = "gRPC"
+	r.ContentLength = -1
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vs := range md {
+		if strings.HasPrefix(k, ":") {
+			if k == ":authority" && len(vs) > 0 {
+				r.Host = vs[0]
+			}
+			continue
+		}
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return serveRecorded(s.Handler, r)
+}
+
+// grpcError converts an unsuccessful response into a gRPC status, passing on any Retry-After as trailer metadata
+func grpcError(ctx context.Context, rec *responseRecorder) error {
+	if rec.status == http.StatusOK {
+		return nil
+	}
+	if ra := rec.header.Get("Retry-After"); ra != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", ra))
+	}
+	resp := &Response{}
+	json.Unmarshal(rec.body.Bytes(), resp)
+	msg := resp.Message
+	if msg == "" {
+		msg = resp.Error
+	}
+	if msg == "" {
+		msg = http.StatusText(rec.status)
+	}
+	code, ok := grpcCodes[rec.status]
+	if !ok {
+		code = codes.Internal
+	}
+	return status.Error(code, msg)
+}
+
+// chunkReader reads the data of the chunks received on a Scan stream
+type chunkReader struct {
+	stream chowderpb.Scanner_ScanServer
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		chunk, err := c.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = chunk.GetData()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// grpcHealth answers the standard gRPC health protocol from the proxy's readiness, as /readyz does
+type grpcHealth struct {
+	healthpb.UnimplementedHealthServer
+	proxy *Proxy
+	poll  time.Duration
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func (h *grpcHealth) Check(_ context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.GetService() != "" && req.GetService() != grpcService {
+		return nil, status.Errorf(codes.NotFound, "unknown service %v", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: h.status()}, nil
+}
+
+// Watch sends the serving status and then every change to it until the client goes away or the server shuts down
+func (h *grpcHealth) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if req.GetService() != "" && req.GetService() != grpcService {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+	poll := h.poll
+	if poll <= 0 {
+		poll = time.Second
+	}
+	t := time.NewTicker(poll)
+	defer t.Stop()
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if s := h.status(); s != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: s}); err != nil {
+				return err
+			}
+			last = s
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-h.stop:
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (h *grpcHealth) status() healthpb.HealthCheckResponse_ServingStatus {
+	if h.proxy.ready() {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// GRPCServer is a gRPC server that Shutdown can stop gracefully
+type GRPCServer struct {
+	*grpc.Server
+	health *grpcHealth
+}
+
+// Shutdown stops accepting calls, ends health watches and waits for calls in progress to finish until ctx is done
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	s.health.once.Do(func() { close(s.health.stop) })
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the server, cancelling calls in progress
+func (s *GRPCServer) Close() error {
+	s.Stop()
+	return nil
+}
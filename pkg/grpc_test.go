@@ -0,0 +1,140 @@
+package chowder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lachlanmunro/chowder/pkg/chowderpb"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcClient connects to a gRPC server in front of the scan and version routes
+func grpcClient(t *testing.T, p *Proxy) (*grpc.ClientConn, func()) {
+	auth, err := NewUsers(map[string]UserEntry{"token": {User: "service"}})
+	assert.Nil(t, err)
+	r := httprouter.New()
+	r.POST("/scan", RequireRole(RoleScanner, p.Scan))
+	r.GET("/version", p.Version)
+	srv := NewGRPCServer(LogRequests(zerolog.Nop(), HeaderAuth(auth, AuthOptions{}, r)), p, time.Millisecond)
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func grpcScan(ctx context.Context, client chowderpb.ScannerClient, chunks ...string) (*chowderpb.ScanResult, error) {
+	stream, err := client.Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chunks {
+		if err = stream.Send(&chowderpb.Chunk{Data: []byte(c)}); err != nil {
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestGRPCScan(t *testing.T) {
+	conn, stop := grpcClient(t, &Proxy{AntiVirus: contentScanner{}})
+	defer stop()
+	client := chowderpb.NewScannerClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+
+	result, err := grpcScan(ctx, client, "hello ", "world")
+	assert.Nil(t, err)
+	assert.False(t, result.Infected)
+	assert.Equal(t, "stream: OK", result.Message)
+
+	result, err = grpcScan(ctx, client, "X5O ", "EI", "CAR")
+	assert.Nil(t, err)
+	assert.True(t, result.Infected)
+	assert.Equal(t, "Eicar-Test-Signature", result.Signature)
+
+	_, err = grpcScan(context.Background(), client, "hello")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	version, err := client.Version(ctx, &chowderpb.VersionRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "ClamAV 1.0.0/27000", version.Antivirus)
+	assert.NotEmpty(t, version.Version)
+}
+
+func TestGRPCScanPassesOnRetryAfter(t *testing.T) {
+	p := &Proxy{AntiVirus: contentScanner{}, Admission: NewAdmission(1, 0, time.Second)}
+	release, err := p.Admission.Acquire(context.Background())
+	assert.Nil(t, err)
+	defer release()
+	conn, stop := grpcClient(t, p)
+	defer stop()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+
+	stream, err := chowderpb.NewScannerClient(conn).Scan(ctx)
+	assert.Nil(t, err)
+	_, err = stream.CloseAndRecv()
+
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, []string{"1"}, stream.Trailer().Get("retry-after"))
+}
+
+func TestGRPCHealth(t *testing.T) {
+	p := &Proxy{AntiVirus: contentScanner{}}
+	conn, stop := grpcClient(t, p)
+	defer stop()
+	client := healthpb.NewHealthClient(conn)
+
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "chowder.v1.Scanner"})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "other"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	resp, err = watch.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	p.Drain()
+	resp, err = watch.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+}
+
+func TestGRPCShutdownEndsHealthWatches(t *testing.T) {
+	srv := NewGRPCServer(http.NotFoundHandler(), &Proxy{AntiVirus: contentScanner{}}, time.Millisecond)
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	watch, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	_, err = watch.Recv()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+}
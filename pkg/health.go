@@ -0,0 +1,276 @@
+package chowder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var (
+	backendUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chowder_backend_up",
+		Help: "Whether the last background health check of the backend succeeded",
+	}, []string{"backend"})
+	backendCheckDurations = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chowder_backend_check_duration_seconds",
+		Help:    "The latency of background backend health checks in seconds",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"backend"})
+	errNotChecked = errors.New("no health check has completed yet")
+)
+
+// BackendStatus is the cached result of a backend's health checks
+type BackendStatus struct {
+	Name      string        `json:"name"`
+	Up        bool          `json:"up"`
+	Checked   time.Time     `json:"checked"`
+	Latency   time.Duration `json:"latency"`
+	Successes int           `json:"consecutive-successes"`
+	Failures  int           `json:"consecutive-failures"`
+	Response  string        `json:"response,omitempty"`
+	LastError string        `json:"last-error,omitempty"`
+	err       error
+}
+
+type monitoredBackend struct {
+	scanner  VirusScanner
+	checking bool
+	status   BackendStatus
+}
+
+// HealthMonitor pings each backend in the background so that probes and load balancer checks are
+// answered from the cached results rather than each dialling clamd
+type HealthMonitor struct {
+	interval time.Duration
+	timeout  time.Duration
+	mu       sync.RWMutex
+	backends []*monitoredBackend
+	changed  func(BackendStatus)
+	notify   sync.Mutex
+	now      func() time.Time
+}
+
+// NewHealthMonitor returns a HealthMonitor checking its backends every interval once Run, with each
+// check failing if it takes longer than the interval
+func NewHealthMonitor(interval time.Duration) *HealthMonitor {
+	return &HealthMonitor{interval: interval, timeout: interval, now: time.Now}
+}
+
+// Add monitors scanner under name, which labels its metrics
+func (m *HealthMonitor) Add(name string, scanner VirusScanner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backends = append(m.backends, &monitoredBackend{scanner: scanner, status: BackendStatus{Name: name, err: errNotChecked}})
+	backendUp.WithLabelValues(name).Set(0)
+}
+
+// OnChange sets a func called (one backend at a time) whenever a backend goes up or down
+func (m *HealthMonitor) OnChange(changed func(BackendStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changed = changed
+}
+
+// Run checks the backends immediately and then every interval until stop is closed
+func (m *HealthMonitor) Run(stop <-chan struct{}) {
+	m.Check()
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			m.Check()
+		}
+	}
+}
+
+// Check pings every backend concurrently and caches the results. A backend whose previous check
+// is still hung is not pinged again until it returns.
+func (m *HealthMonitor) Check() {
+	m.mu.Lock()
+	var pending []*monitoredBackend
+	for _, b := range m.backends {
+		if !b.checking {
+			b.checking = true
+			pending = append(pending, b)
+		}
+	}
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, b := range pending {
+		wg.Add(1)
+		go func(b *monitoredBackend) {
+			defer wg.Done()
+			m.check(b)
+		}(b)
+	}
+	wg.Wait()
+}
+
+type healthResult struct {
+	ok  bool
+	msg string
+	err error
+}
+
+func (m *HealthMonitor) check(b *monitoredBackend) {
+	start := m.now()
+	done := make(chan healthResult, 1)
+	go func() {
+		ok, msg, err := b.scanner.Ok()
+		done <- healthResult{ok, msg, err}
+		m.mu.Lock()
+		b.checking = false
+		m.mu.Unlock()
+	}()
+	var res healthResult
+	var timeout <-chan time.Time
+	if m.timeout > 0 {
+		t := time.NewTimer(m.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case res = <-done:
+	case <-timeout:
+		res.err = fmt.Errorf("health check timed out after %v", m.timeout)
+	}
+	latency := m.now().Sub(start)
+	m.mu.Lock()
+	s := &b.status
+	s.Checked, s.Latency, s.Response, s.err = m.now(), latency, res.msg, res.err
+	s.Up = res.ok && res.err == nil
+	if s.Up {
+		s.Successes++
+		s.Failures = 0
+	} else {
+		s.Failures++
+		s.Successes = 0
+		if res.err != nil {
+			s.LastError = res.err.Error()
+		} else {
+			s.LastError = fmt.Sprintf("unexpected response '%v'", res.msg)
+		}
+	}
+	status, changed := *s, m.changed
+	m.mu.Unlock()
+	backendCheckDurations.WithLabelValues(status.Name).Observe(latency.Seconds())
+	if status.Up {
+		backendUp.WithLabelValues(status.Name).Set(1)
+	} else {
+		backendUp.WithLabelValues(status.Name).Set(0)
+	}
+	// the counters restart whenever the backend goes up or down, including on its first check
+	if changed != nil && status.Successes+status.Failures == 1 {
+		m.notify.Lock()
+		defer m.notify.Unlock()
+		changed(status)
+	}
+}
+
+// Backends returns the cached status of every backend
+func (m *HealthMonitor) Backends() []BackendStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	statuses := make([]BackendStatus, len(m.backends))
+	for i, b := range m.backends {
+		statuses[i] = b.status
+	}
+	return statuses
+}
+
+// Status is ok if any backend's last check succeeded, otherwise it reports the first backend's failure
+func (m *HealthMonitor) Status() (ok bool, msg string, err error) {
+	statuses := m.Backends()
+	for _, s := range statuses {
+		if s.Up {
+			return true, s.Response, nil
+		}
+	}
+	if len(statuses) == 0 {
+		return false, "", errNotChecked
+	}
+	return false, statuses[0].Response, statuses[0].err
+}
+
+// Live answers a liveness probe, succeeding whenever chowder itself can serve requests
+func (p *Proxy) Live(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeResponse(w, r, &Response{
+		Message: "Live",
+	}, http.StatusOK)
+}
+
+// HealthResponse is a response to a health check with the status of each backend
+type HealthResponse struct {
+	Response
+	Backends []BackendStatus `json:"backends,omitempty"`
+}
+
+// Ready answers a readiness probe, failing while draining or while the antivirus is down. With a
+// HealthMonitor the antivirus status is served from its cache, otherwise it is pinged as Ok does. As probes
+// are served without authentication only a fixed message is returned, the reason being logged.
+func (p *Proxy) Ready(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status, resp := p.readiness(r)
+	writeResponse(w, r, &Response{Message: resp.Message}, status)
+}
+
+// Healthz answers like Ready with why the antivirus is down, adding the cached status of every backend
+// when there is a HealthMonitor
+func (p *Proxy) Healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status, resp := p.readiness(r)
+	health := &HealthResponse{Response: *resp}
+	if p.Health != nil {
+		health.Backends = p.Health.Backends()
+	}
+	writeResponse(w, r, health, status)
+}
+
+// readiness returns the status and response to answer a readiness probe with
+func (p *Proxy) readiness(r *http.Request) (int, *Response) {
+	if p.Health == nil || p.Draining() {
+		return p.pingStatus(r)
+	}
+	ok, msg, err := p.Health.Status()
+	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+		return l.Bool("ok", ok).Str("daemon-response", msg).AnErr("health-error", err)
+	})
+	if err != nil {
+		return http.StatusInternalServerError, &Response{
+			Message: "Down",
+			Error:   fmt.Sprintf("%v - daemon response: %v", err.Error(), msg),
+		}
+	}
+	if !ok {
+		return http.StatusInternalServerError, &Response{
+			Message: "Down",
+			Error:   msg,
+		}
+	}
+	return http.StatusOK, &Response{
+		Message: "Up",
+	}
+}
+
+// ready reports whether Ready would succeed, for probes over other protocols
+func (p *Proxy) ready() bool {
+	if p.Draining() {
+		return false
+	}
+	var ok bool
+	var err error
+	if p.Health != nil {
+		ok, _, err = p.Health.Status()
+	} else {
+		ok, _, err = p.AntiVirus.Ok()
+	}
+	return ok && err == nil
+}
@@ -0,0 +1,121 @@
+package chowder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func probe(handle func(http.ResponseWriter, *http.Request), path string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	handle(rw, httptest.NewRequest(http.MethodGet, path, nil))
+	return rw
+}
+
+func TestReadyServesCachedHealth(t *testing.T) {
+	mav := &mockAntiVirus{}
+	mav.On("Ok").Once().Return(true, "PONG", nil)
+	sut := &Proxy{AntiVirus: mav, Health: NewHealthMonitor(0)}
+	sut.Health.Add("clamd", mav)
+	ready := func(w http.ResponseWriter, r *http.Request) { sut.Ready(w, r, nil) }
+
+	rw := probe(ready, "/readyz")
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	// the unauthenticated probe does not give away why, unlike /healthz
+	assert.Equal(t, `{"message":"Down"}`, rw.Body.String())
+	rw = probe(func(w http.ResponseWriter, r *http.Request) { sut.Healthz(w, r, nil) }, "/healthz")
+	assert.Contains(t, rw.Body.String(), `"error":"no health check has completed yet - daemon response: "`)
+
+	sut.Health.Check()
+	for i := 0; i < 3; i++ {
+		rw = probe(ready, "/readyz")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, `{"message":"Up"}`, rw.Body.String())
+	}
+	mav.AssertNumberOfCalls(t, "Ok", 1)
+
+	mav.On("Ok").Once().Return(false, "", errors.New("connection refused"))
+	sut.Health.Check()
+	assert.Equal(t, http.StatusInternalServerError, probe(ready, "/readyz").Code)
+
+	sut.Drain()
+	assert.Equal(t, `{"message":"Draining"}`, probe(ready, "/readyz").Body.String())
+}
+
+func TestHealthMonitorTracksBackends(t *testing.T) {
+	up, down, hung := &mockAntiVirus{}, &mockAntiVirus{}, &mockAntiVirus{}
+	up.On("Ok").Return(true, "PONG", nil)
+	down.On("Ok").Return(false, "", errors.New("connection refused"))
+	release := make(chan struct{})
+	hung.On("Ok").Run(func(mock.Arguments) { <-release }).Return(true, "PONG", nil)
+	sut := NewHealthMonitor(time.Second)
+	sut.timeout = 10 * time.Millisecond
+	sut.Add("down", down)
+	sut.Add("hung", hung)
+	var changes []string
+	sut.OnChange(func(s BackendStatus) { changes = append(changes, fmt.Sprintf("%v:%v", s.Name, s.Up)) })
+
+	sut.Check()
+	sut.Check()
+
+	ok, _, err := sut.Status()
+	assert.False(t, ok)
+	assert.EqualError(t, err, "connection refused")
+	statuses := sut.Backends()
+	assert.Equal(t, 2, statuses[0].Failures)
+	assert.Equal(t, "connection refused", statuses[0].LastError)
+	assert.Equal(t, "health check timed out after 10ms", statuses[1].LastError)
+	// the hung backend is not pinged again until its first check returns
+	hung.AssertNumberOfCalls(t, "Ok", 1)
+	close(release)
+
+	sut.Add("up", up)
+	sut.Check()
+	ok, msg, err := sut.Status()
+	assert.True(t, ok)
+	assert.Equal(t, "PONG", msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sut.Backends()[2].Successes)
+	assert.ElementsMatch(t, []string{"down:false", "hung:false", "up:true"}, changes)
+}
+
+func TestHealthzServesEachBackend(t *testing.T) {
+	up, down := &mockAntiVirus{}, &mockAntiVirus{}
+	up.On("Ok").Return(true, "PONG", nil)
+	down.On("Ok").Return(false, "", errors.New("connection refused"))
+	sut := &Proxy{AntiVirus: up, Health: NewHealthMonitor(0)}
+	sut.Health.Add("up", up)
+	sut.Health.Add("down", down)
+	sut.Health.Check()
+
+	rw := probe(func(w http.ResponseWriter, r *http.Request) { sut.Healthz(w, r, nil) }, "/healthz")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	resp := &HealthResponse{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), resp))
+	assert.Equal(t, "Up", resp.Message)
+	assert.Len(t, resp.Backends, 2)
+	assert.Equal(t, "up", resp.Backends[0].Name)
+	assert.Equal(t, 1, resp.Backends[0].Successes)
+	assert.False(t, resp.Backends[1].Up)
+	assert.Equal(t, 1, resp.Backends[1].Failures)
+	assert.Equal(t, "connection refused", resp.Backends[1].LastError)
+}
+
+func TestLiveDoesNotDependOnTheAntivirus(t *testing.T) {
+	mav := &mockAntiVirus{}
+	sut := &Proxy{AntiVirus: mav}
+
+	rw := probe(func(w http.ResponseWriter, r *http.Request) { sut.Live(w, r, nil) }, "/livez")
+
+	mav.AssertNotCalled(t, "Ok")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, `{"message":"Live"}`, rw.Body.String())
+}
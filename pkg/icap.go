@@ -0,0 +1,557 @@
+package chowder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxICAPHeaderSection bounds each encapsulated HTTP header section read into memory
+	maxICAPHeaderSection = 1 << 20
+	// icapDrainLimit is how much unread body is discarded to keep a connection open after a rejection
+	icapDrainLimit = 64 * 1024
+	// DefaultICAPEchoSize bounds the content kept to send back to ICAP clients that do not allow 204 if not set
+	DefaultICAPEchoSize = 10 << 20
+)
+
+var (
+	icapRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_icap_requests_total",
+		Help: "The total number of ICAP requests by method and ICAP status",
+	}, []string{"method", "status"})
+	icapStatusText = map[int]string{
+		100: "Continue",
+		200: "OK",
+		204: "No Content",
+		400: "Bad Request",
+		403: "Forbidden",
+		404: "ICAP Service Not Found",
+		405: "Method Not Allowed For Service",
+		500: "Server Error",
+		501: "Method Not Implemented",
+		503: "Service Overloaded",
+		505: "ICAP Version Not Supported",
+	}
+	// DefaultBlockPage is served in place of infected content, given the Signature and URL
+	DefaultBlockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html><head><title>Blocked</title></head>
+<body><h1>Blocked</h1><p>The content{{if .URL}} from {{.URL}}{{end}} was blocked because it contains {{.Signature}}.</p></body>
+</html>
+`))
+)
+
+// ICAPServer answers ICAP (RFC 3507) REQMOD and RESPMOD requests, e.g. from Squid, by scanning the
+// encapsulated HTTP body. Bodies are handed to Handler as a POST /scan request carrying the ICAP headers
+// (so e.g. `adaptation_meta Authorization "Bearer <token>"` authenticates), which gives ICAP scans
+// the same authentication, limits, quotas, metrics, logs and audit trail as the HTTP API.
+type ICAPServer struct {
+	Handler http.Handler
+	// Service names the service in OPTIONS responses
+	Service string
+	// ISTag identifies the service's state, changing it invalidates verdicts clients have cached
+	ISTag string
+	// Preview is the number of body bytes clients are asked to send before the rest, 0 disables previews
+	Preview int
+	// BlockPage renders the body of the 403 response replacing infected content, DefaultBlockPage if nil
+	BlockPage *template.Template
+	// MaxEcho bounds the content kept to send back to clients that do not allow 204, DefaultICAPEchoSize if
+	// not positive. Larger content is answered with an error.
+	MaxEcho int64
+	// IdleTimeout closes connections waiting longer than this for a request, 0 never does
+	IdleTimeout time.Duration
+	connServer
+}
+
+// ListenAndServe listens on the TCP address and serves ICAP until Shutdown or Close
+func (s *ICAPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve answers ICAP connections accepted from l, returning nil once the server is shut down
+func (s *ICAPServer) Serve(l net.Listener) error {
+	return s.serve(l, s.serveConn)
+}
+
+func (s *ICAPServer) serveConn(c net.Conn) {
+	defer s.untrack(c)
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	for {
+		if s.IdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		req, err := readICAPRequest(br)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Debug().Str("remote-address", c.RemoteAddr().String()).Msg("closing idle icap connection")
+				return
+			}
+			if err != io.EOF && !s.closed() {
+				log.Debug().Err(err).Str("remote-address", c.RemoteAddr().String()).Msg("malformed icap request")
+				s.writeStatus(bw, "", 400, nil)
+				bw.Flush()
+			}
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if !s.track(c, true) {
+			return
+		}
+		req.remote = c.RemoteAddr().String()
+		keepAlive := s.serveRequest(bw, req)
+		if err = bw.Flush(); err != nil || !keepAlive || strings.EqualFold(req.header.Get("Connection"), "close") {
+			return
+		}
+		if !s.track(c, false) {
+			return
+		}
+	}
+}
+
+// icapRequest is an ICAP request whose encapsulated body (if any) has not been read yet
+type icapRequest struct {
+	method  string
+	uri     *url.URL
+	rawURI  string
+	header  textproto.MIMEHeader
+	remote  string
+	reqHdr  []byte
+	resHdr  []byte
+	body    *icapBody
+	allow   map[string]bool
+	preview bool
+}
+
+func readICAPRequest(br *bufio.Reader) (*icapRequest, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "ICAP/") {
+		return nil, fmt.Errorf("malformed request line '%v'", line)
+	}
+	uri, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed request uri: %v", err)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("malformed headers: %w", err)
+	}
+	req := &icapRequest{method: parts[0], uri: uri, rawURI: parts[1], header: header, allow: make(map[string]bool)}
+	for _, a := range strings.Split(header.Get("Allow"), ",") {
+		req.allow[strings.TrimSpace(a)] = true
+	}
+	_, req.preview = header["Preview"]
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return nil, err
+	}
+	for i, sec := range sections {
+		if i == len(sections)-1 {
+			switch sec.name {
+			case "req-body", "res-body", "opt-body":
+				req.body = &icapBody{r: br, preview: req.preview}
+			case "null-body":
+			default:
+				return nil, fmt.Errorf("encapsulated %v must be followed by a body", sec.name)
+			}
+			break
+		}
+		n := sections[i+1].offset - sec.offset
+		if n < 0 || n > maxICAPHeaderSection {
+			return nil, fmt.Errorf("encapsulated %v of %v bytes is unsupported", sec.name, n)
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return nil, fmt.Errorf("could not read encapsulated %v: %w", sec.name, err)
+		}
+		switch sec.name {
+		case "req-hdr":
+			req.reqHdr = b
+		case "res-hdr":
+			req.resHdr = b
+		default:
+			return nil, fmt.Errorf("unknown encapsulated section %v", sec.name)
+		}
+	}
+	return req, nil
+}
+
+type icapSection struct {
+	name   string
+	offset int
+}
+
+// parseEncapsulated parses e.g. `req-hdr=0, res-hdr=137, res-body=296` in offset order
+func parseEncapsulated(h string) ([]icapSection, error) {
+	if strings.TrimSpace(h) == "" {
+		return nil, nil
+	}
+	var sections []icapSection
+	for _, part := range strings.Split(h, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed encapsulated header '%v'", h)
+		}
+		offset, err := strconv.Atoi(kv[1])
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("malformed encapsulated header '%v'", h)
+		}
+		sections = append(sections, icapSection{name: kv[0], offset: offset})
+	}
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].offset < sections[j].offset })
+	return sections, nil
+}
+
+// icapBody reads a chunked encapsulated body, asking the client for the rest of the body with
+// 100 Continue when a preview ends without ieof
+type icapBody struct {
+	r         *bufio.Reader
+	preview   bool
+	continued func() error
+	remaining int64
+	eof       bool
+	// whole is set once the entire body has been read, false if the reader stopped after a preview
+	whole bool
+	// continuedSent is set once the client has been asked for the rest of the body after a preview
+	continuedSent bool
+}
+
+func (b *icapBody) Read(p []byte) (int, error) {
+	for b.remaining == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		line, err := readICAPLine(b.r)
+		if err != nil {
+			return 0, err
+		}
+		size, ext := line, ""
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			size, ext = line[:i], line[i+1:]
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("malformed chunk size '%v'", line)
+		}
+		if n > 0 {
+			b.remaining = n
+			break
+		}
+		// skip any trailers up to the blank line ending the body
+		for {
+			if line, err = readICAPLine(b.r); err != nil {
+				return 0, err
+			}
+			if line == "" {
+				break
+			}
+		}
+		if !b.preview || strings.TrimSpace(ext) == "ieof" {
+			b.eof, b.whole = true, true
+			return 0, io.EOF
+		}
+		b.preview = false
+		if b.continued == nil {
+			b.eof = true
+			return 0, io.EOF
+		}
+		if err = b.continued(); err != nil {
+			return 0, err
+		}
+		b.continuedSent = true
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	if b.remaining == 0 {
+		if line, err := readICAPLine(b.r); err != nil || line != "" {
+			return n, fmt.Errorf("malformed chunk ending")
+		}
+	}
+	return n, nil
+}
+
+// discard reads what is left of the body without asking for more after a preview, reporting
+// whether the connection is still usable for the next request
+func (b *icapBody) discard() bool {
+	b.continued = nil
+	_, err := io.Copy(ioutil.Discard, io.LimitReader(b, icapDrainLimit))
+	return err == nil && b.eof
+}
+
+func readICAPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// serveRequest answers req, reporting whether the connection may serve another request
+func (s *ICAPServer) serveRequest(w *bufio.Writer, req *icapRequest) bool {
+	switch req.method {
+	case "OPTIONS":
+		h := textproto.MIMEHeader{}
+		h.Set("Methods", "REQMOD, RESPMOD")
+		h.Set("Service", s.service())
+		h.Set("Options-TTL", "3600")
+		h.Set("Allow", "204")
+		if s.Preview > 0 {
+			h.Set("Preview", strconv.Itoa(s.Preview))
+			h.Set("Transfer-Preview", "*")
+		}
+		h.Set("Encapsulated", "null-body=0")
+		s.writeStatus(w, req.method, 200, h)
+	case "REQMOD", "RESPMOD":
+		return s.modify(w, req)
+	default:
+		s.writeStatus(w, req.method, 501, nil)
+	}
+	return req.body == nil || req.body.discard()
+}
+
+// modify scans the body of a REQMOD or RESPMOD request, answering 204 (or echoing the message when
+// the client does not allow 204) when clean and a block page when infected
+func (s *ICAPServer) modify(w *bufio.Writer, req *icapRequest) bool {
+	hdr := req.reqHdr
+	if req.method == "RESPMOD" {
+		hdr = req.resHdr
+	}
+	if req.body == nil {
+		// nothing to scan, e.g. a GET request
+		if req.allow["204"] {
+			s.writeStatus(w, req.method, 204, nil)
+		} else {
+			s.writeEcho(w, req, hdr, nil)
+		}
+		return true
+	}
+	var echo *echoBuffer
+	var body io.Reader = req.body
+	if !req.allow["204"] {
+		// without 204 a clean message has to be sent back, so it is kept as it streams to the scanner
+		echo = &echoBuffer{max: s.maxEcho()}
+		body = io.TeeReader(req.body, echo)
+	}
+	req.body.continued = func() error {
+		s.writeStatus(w, req.method, 100, nil)
+		return w.Flush()
+	}
+	rec := s.scan(req, body)
+	keepAlive := req.body.discard()
+	resp := &ScanResponse{}
+	if rec.status == http.StatusOK {
+		if err := json.Unmarshal(rec.body.Bytes(), resp); err != nil {
+			rec.status = http.StatusInternalServerError
+		}
+	}
+	switch {
+	case echo != nil && echo.exceeded:
+		log.Debug().Str("remote-address", req.remote).Int64("max-echo", echo.max).Msg("icap content too large to echo")
+		s.writeStatus(w, req.method, 500, nil)
+		return false
+	case rec.status == http.StatusOK && resp.Infected:
+		s.writeBlockPage(w, req, resp.Message)
+	case rec.status == http.StatusOK && (req.allow["204"] || (req.preview && req.body.whole && !req.body.continuedSent)):
+		s.writeStatus(w, req.method, 204, nil)
+	case rec.status == http.StatusOK && req.body.whole:
+		s.writeEcho(w, req, hdr, echo.Bytes())
+	case rec.status == http.StatusOK:
+		// the scan stopped early (e.g. a preview was never continued), so there is no verdict
+		s.writeStatus(w, req.method, 500, nil)
+		return false
+	case rec.status == http.StatusTooManyRequests || rec.status == http.StatusServiceUnavailable:
+		s.writeStatus(w, req.method, 503, nil)
+	case rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden:
+		s.writeStatus(w, req.method, 403, nil)
+	case rec.status < 500:
+		s.writeStatus(w, req.method, 400, nil)
+	default:
+		s.writeStatus(w, req.method, 500, nil)
+	}
+	return keepAlive
+}
+
+func (s *ICAPServer) maxEcho() int64 {
+	if s.MaxEcho <= 0 {
+		return DefaultICAPEchoSize
+	}
+	return s.MaxEcho
+}
+
+// echoBuffer keeps the content written to it up to max bytes, failing writes past it
+type echoBuffer struct {
+	bytes.Buffer
+	max      int64
+	exceeded bool
+}
+
+func (b *echoBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.max {
+		b.exceeded = true
+		return 0, fmt.Errorf("content is larger than the %v bytes that can be echoed", b.max)
+	}
+	return b.Buffer.Write(p)
+}
+
+// scan hands body to the Handler as a POST /scan request carrying the ICAP headers
+func (s *ICAPServer) scan(req *icapRequest, body io.Reader) *responseRecorder {
+	r, err := http.NewRequest(http.MethodPost, "/scan", ioutil.NopCloser(body))
+	if err != nil {
+		return &responseRecorder{status: http.StatusInternalServerError}
+	}
+	r.RequestURI = req.rawURI
+	r.Proto = "ICAP/1.0"
+	r.Header = http.Header(req.header)
+	r.Host = req.uri.Host
+	r.RemoteAddr = req.remote
+	r.ContentLength = -1
+	return serveRecorded(s.Handler, r)
+}
+
+func (s *ICAPServer) writeStatus(w *bufio.Writer, method string, status int, h textproto.MIMEHeader) {
+	text, ok := icapStatusText[status]
+	if !ok {
+		text = http.StatusText(status)
+	}
+	fmt.Fprintf(w, "ICAP/1.0 %d %s\r\n", status, text)
+	if status != 100 {
+		fmt.Fprintf(w, "ISTag: %q\r\n", s.istag())
+		if h == nil || h.Get("Encapsulated") == "" {
+			fmt.Fprintf(w, "Encapsulated: null-body=0\r\n")
+		}
+		if method != "" {
+			icapRequests.WithLabelValues(method, strconv.Itoa(status)).Inc()
+		}
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// writeEcho returns the original HTTP message unmodified
+func (s *ICAPServer) writeEcho(w *bufio.Writer, req *icapRequest, hdr, body []byte) {
+	prefix := "req"
+	if req.method == "RESPMOD" {
+		prefix = "res"
+	}
+	s.writeEncapsulated(w, req.method, prefix, hdr, body, req.body != nil, nil)
+}
+
+// writeBlockPage replaces the HTTP message with a 403 response explaining what was found
+func (s *ICAPServer) writeBlockPage(w *bufio.Writer, req *icapRequest, msg string) {
+	sig := Signature(msg)
+	page := s.BlockPage
+	if page == nil {
+		page = DefaultBlockPage
+	}
+	var body bytes.Buffer
+	if err := page.Execute(&body, struct{ Signature, URL string }{sig, blockedURL(req)}); err != nil {
+		log.Error().Err(err).Msg("failed rendering icap block page")
+		body.Reset()
+		body.WriteString("Blocked: " + sig + "\n")
+	}
+	hdr := fmt.Sprintf("HTTP/1.1 403 Forbidden\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nCache-Control: no-store\r\nConnection: close\r\n\r\n", body.Len())
+	h := textproto.MIMEHeader{}
+	h.Set("X-Infection-Found", fmt.Sprintf("Type=0; Resolution=2; Threat=%s;", sig))
+	h.Set("X-Virus-ID", sig)
+	s.writeEncapsulated(w, req.method, "res", []byte(hdr), body.Bytes(), true, h)
+}
+
+func (s *ICAPServer) writeEncapsulated(w *bufio.Writer, method, prefix string, hdr, body []byte, hasBody bool, h textproto.MIMEHeader) {
+	if h == nil {
+		h = textproto.MIMEHeader{}
+	}
+	bodySection := prefix + "-body"
+	if !hasBody {
+		bodySection = "null-body"
+	}
+	if len(hdr) > 0 {
+		h.Set("Encapsulated", fmt.Sprintf("%s-hdr=0, %s=%d", prefix, bodySection, len(hdr)))
+	} else {
+		h.Set("Encapsulated", fmt.Sprintf("%s=0", bodySection))
+	}
+	s.writeStatus(w, method, 200, h)
+	w.Write(hdr)
+	if !hasBody {
+		return
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(w, "%x\r\n", len(body))
+		w.Write(body)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("0\r\n\r\n")
+}
+
+// blockedURL reads the URL of the encapsulated request from its request line, if there is one
+func blockedURL(req *icapRequest) string {
+	line := string(req.reqHdr)
+	if i := strings.Index(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	if parts := strings.Split(line, " "); len(parts) == 3 {
+		return parts[1]
+	}
+	return ""
+}
+
+func (s *ICAPServer) service() string {
+	if s.Service == "" {
+		return "chowder"
+	}
+	return s.Service
+}
+
+func (s *ICAPServer) istag() string {
+	if s.ISTag == "" {
+		return "chowder"
+	}
+	return s.ISTag
+}
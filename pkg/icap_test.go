@@ -0,0 +1,216 @@
+package chowder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// contentScanner reads streams to the end like clamd, flagging those containing EICAR as infected
+type contentScanner struct{}
+
+func (contentScanner) Scan(stream io.Reader) (bool, string, error) {
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return false, "", err
+	}
+	if bytes.Contains(b, []byte("EICAR")) {
+		return true, "stream: Eicar-Test-Signature FOUND", nil
+	}
+	return false, "stream: OK", nil
+}
+
+func (contentScanner) Ok() (bool, string, error) {
+	return true, "PONG", nil
+}
+
+func (contentScanner) Version() (string, error) {
+	return "ClamAV 1.0.0/27000", nil
+}
+
+type icapResponse struct {
+	status int
+	header textproto.MIMEHeader
+	hdr    string
+	body   string
+}
+
+// icapClient sends raw ICAP requests to an ICAPServer in front of the scan route
+func icapClient(t *testing.T, users map[string]UserEntry, configure ...func(*ICAPServer)) (conn net.Conn, br *bufio.Reader, stop func()) {
+	auth, err := NewUsers(users)
+	assert.Nil(t, err)
+	r := httprouter.New()
+	r.POST("/scan", RequireRole(RoleScanner, (&Proxy{AntiVirus: contentScanner{}}).Scan))
+	sut := &ICAPServer{Handler: LogRequests(zerolog.Nop(), HeaderAuth(auth, AuthOptions{}, r)), ISTag: "test", Preview: 4}
+	for _, c := range configure {
+		c(sut)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- sut.Serve(l)
+	}()
+	conn, err = net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	return conn, bufio.NewReader(conn), func() {
+		conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Nil(t, sut.Shutdown(ctx))
+		assert.Nil(t, <-served)
+	}
+}
+
+func readICAPResponse(t *testing.T, br *bufio.Reader) *icapResponse {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	assert.Nil(t, err)
+	resp := &icapResponse{}
+	_, err = fmt.Sscanf(line, "ICAP/1.0 %d", &resp.status)
+	assert.Nil(t, err, line)
+	resp.header, err = tp.ReadMIMEHeader()
+	assert.Nil(t, err)
+	sections, err := parseEncapsulated(resp.header.Get("Encapsulated"))
+	assert.Nil(t, err)
+	for i, sec := range sections {
+		if i < len(sections)-1 {
+			b := make([]byte, sections[i+1].offset-sec.offset)
+			_, err = io.ReadFull(br, b)
+			assert.Nil(t, err)
+			resp.hdr = string(b)
+		} else if sec.name != "null-body" {
+			b, err := ioutil.ReadAll(&icapBody{r: br})
+			assert.Nil(t, err)
+			resp.body = string(b)
+		}
+	}
+	return resp
+}
+
+func chunk(s string) string {
+	return fmt.Sprintf("%x\r\n%s\r\n", len(s), s)
+}
+
+const icapResHdr = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+
+func respmod(headers, body string) string {
+	reqHdr := "GET http://example.com/file.txt HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	return fmt.Sprintf("RESPMOD icap://chowder/respmod ICAP/1.0\r\nHost: chowder\r\n%vEncapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n%v%v%v0\r\n\r\n",
+		headers, len(reqHdr), len(reqHdr)+len(icapResHdr), reqHdr, icapResHdr, chunk(body))
+}
+
+func TestICAPOptions(t *testing.T) {
+	conn, br, stop := icapClient(t, nil)
+	defer stop()
+
+	fmt.Fprint(conn, "OPTIONS icap://chowder/respmod ICAP/1.0\r\nHost: chowder\r\n\r\n")
+	resp := readICAPResponse(t, br)
+
+	assert.Equal(t, 200, resp.status)
+	assert.Equal(t, "REQMOD, RESPMOD", resp.header.Get("Methods"))
+	assert.Equal(t, `"test"`, resp.header.Get("ISTag"))
+	assert.Equal(t, "204", resp.header.Get("Allow"))
+	assert.Equal(t, "4", resp.header.Get("Preview"))
+}
+
+func TestICAPRespmodBlocksInfectedContent(t *testing.T) {
+	conn, br, stop := icapClient(t, nil)
+	defer stop()
+
+	fmt.Fprint(conn, respmod("Allow: 204\r\n", "hello"))
+	resp := readICAPResponse(t, br)
+	assert.Equal(t, 204, resp.status)
+
+	// the connection persists across requests
+	fmt.Fprint(conn, respmod("Allow: 204\r\n", "X5O EICAR payload"))
+	resp = readICAPResponse(t, br)
+	assert.Equal(t, 200, resp.status)
+	assert.Contains(t, resp.header.Get("X-Infection-Found"), "Threat=Eicar-Test-Signature;")
+	assert.True(t, strings.HasPrefix(resp.hdr, "HTTP/1.1 403 Forbidden\r\n"), resp.hdr)
+	assert.Contains(t, resp.body, "http://example.com/file.txt was blocked because it contains Eicar-Test-Signature")
+}
+
+func TestICAPEchoesCleanContentWithout204(t *testing.T) {
+	conn, br, stop := icapClient(t, nil)
+	defer stop()
+
+	fmt.Fprint(conn, respmod("", "hello"))
+	resp := readICAPResponse(t, br)
+
+	assert.Equal(t, 200, resp.status)
+	assert.Equal(t, icapResHdr, resp.hdr)
+	assert.Equal(t, "hello", resp.body)
+}
+
+func TestICAPRefusesToEchoContentOverTheLimit(t *testing.T) {
+	conn, br, stop := icapClient(t, nil, func(s *ICAPServer) {
+		s.MaxEcho = 8
+	})
+	defer stop()
+
+	fmt.Fprint(conn, respmod("", "more than eight bytes"))
+	resp := readICAPResponse(t, br)
+
+	assert.Equal(t, 500, resp.status)
+}
+
+func TestICAPClosesIdleConnections(t *testing.T) {
+	conn, br, stop := icapClient(t, nil, func(s *ICAPServer) {
+		s.IdleTimeout = 50 * time.Millisecond
+	})
+	defer stop()
+
+	// a request that never finishes is not waited on forever
+	fmt.Fprint(conn, "OPTIONS icap://chowder/respmod ICAP/1.0\r\nHost: chowder\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestICAPReqmodPreview(t *testing.T) {
+	conn, br, stop := icapClient(t, nil)
+	defer stop()
+	reqHdr := "POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	start := fmt.Sprintf("REQMOD icap://chowder/reqmod ICAP/1.0\r\nHost: chowder\r\nAllow: 204\r\nPreview: 4\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n%v", len(reqHdr), reqHdr)
+
+	// a body that fits in the preview is answered straight away
+	fmt.Fprint(conn, start+chunk("tiny")+"0; ieof\r\n\r\n")
+	assert.Equal(t, 204, readICAPResponse(t, br).status)
+
+	// otherwise chowder asks for the rest so the whole body is scanned
+	fmt.Fprint(conn, start+chunk("X5O ")+"0\r\n\r\n")
+	assert.Equal(t, 100, readICAPResponse(t, br).status)
+	fmt.Fprint(conn, chunk("EICAR")+"0\r\n\r\n")
+	resp := readICAPResponse(t, br)
+	assert.Equal(t, 200, resp.status)
+	assert.Contains(t, resp.body, "Eicar-Test-Signature")
+}
+
+func TestICAPAuthenticatesFromICAPHeaders(t *testing.T) {
+	conn, br, stop := icapClient(t, map[string]UserEntry{"token": {User: "squid"}})
+	defer stop()
+
+	fmt.Fprint(conn, respmod("Allow: 204\r\n", "hello"))
+	assert.Equal(t, 403, readICAPResponse(t, br).status)
+
+	fmt.Fprint(conn, respmod("Allow: 204\r\nAuthorization: Bearer token\r\n", "hello"))
+	assert.Equal(t, 204, readICAPResponse(t, br).status)
+}
+
+func TestSignature(t *testing.T) {
+	assert.Equal(t, "Eicar-Test-Signature", Signature("stream: Eicar-Test-Signature FOUND"))
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", Signature("stream: Win.Test.EICAR_HDB-1 FOUND\000"))
+}
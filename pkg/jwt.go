@@ -0,0 +1,470 @@
+package chowder
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes used by RS/PS/ES algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	jwtResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_jwt_validations_total",
+		Help: "The total number of JWT validations by result",
+	}, []string{"result"})
+	jwksRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_jwks_refreshes_total",
+		Help: "The total number of JWKS loads by result",
+	}, []string{"result"})
+	errUnknownKey                        = errors.New("no key matches the token")
+	_                 TokenAuthenticator = &JWTAuth{}
+	jwtSigningMethods                    = map[string]jwtMethod{
+		"RS256": {"RSA", crypto.SHA256}, "RS384": {"RSA", crypto.SHA384}, "RS512": {"RSA", crypto.SHA512},
+		"PS256": {"RSA", crypto.SHA256}, "PS384": {"RSA", crypto.SHA384}, "PS512": {"RSA", crypto.SHA512},
+		"ES256": {"EC", crypto.SHA256}, "ES384": {"EC", crypto.SHA384}, "ES512": {"EC", crypto.SHA512},
+		"EdDSA": {"OKP", 0},
+	}
+)
+
+type jwtMethod struct {
+	kty  string
+	hash crypto.Hash
+}
+
+// JWTOptions configures the claims a JWTAuth requires
+type JWTOptions struct {
+	// Issuer must match the iss claim if set
+	Issuer string
+	// Audience must be one of the aud claim values if set
+	Audience string
+	// UserClaim is the claim used as the username, defaulting to sub
+	UserClaim string
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway time.Duration
+	// RoleScopePrefix marks the scopes that grant chowder roles, e.g. `chowder:scanner` with the default
+	// `chowder:`. Tokens without any such scope are granted DefaultRoles.
+	RoleScopePrefix string
+}
+
+// DefaultRoleScopePrefix is the RoleScopePrefix used when none is configured
+const DefaultRoleScopePrefix = "chowder:"
+
+// JWTAuth authenticates signed JWTs (RS, PS, ES and EdDSA algorithms) against a JWKS
+type JWTAuth struct {
+	opts JWTOptions
+	keys *JWKS
+	now  func() time.Time
+}
+
+// NewJWTAuth returns a JWTAuth validating tokens with keys from the supplied JWKS
+func NewJWTAuth(keys *JWKS, opts JWTOptions) *JWTAuth {
+	if opts.UserClaim == "" {
+		opts.UserClaim = "sub"
+	}
+	if opts.RoleScopePrefix == "" {
+		opts.RoleScopePrefix = DefaultRoleScopePrefix
+	}
+	return &JWTAuth{opts: opts, keys: keys, now: time.Now}
+}
+
+// Enabled reports whether a JWKS is configured
+func (j *JWTAuth) Enabled() bool {
+	return j != nil && j.keys != nil
+}
+
+// AuthenticateToken validates token as a JWT, returning the Identity named by its user claim
+func (j *JWTAuth) AuthenticateToken(token string) (*Identity, bool) {
+	if strings.Count(token, ".") != 2 {
+		return nil, false
+	}
+	id, err := j.Validate(token)
+	if err != nil {
+		jwtResults.WithLabelValues("invalid").Inc()
+		log.Debug().Err(err).Msg("rejected jwt")
+		return nil, false
+	}
+	jwtResults.WithLabelValues("valid").Inc()
+	return id, true
+}
+
+// Validate checks the signature and claims of a compact serialised JWT
+func (j *JWTAuth) Validate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt must have 3 parts")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %v", err)
+	}
+	method, ok := jwtSigningMethods[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("jwt algorithm '%v' is not supported", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt signature encoding: %v", err)
+	}
+	key, err := j.keys.Key(header.Kid, header.Alg, method.kty)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyJWTSignature(header.Alg, method, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt claims: %v", err)
+	}
+	return j.checkClaims(claims)
+}
+
+func (j *JWTAuth) checkClaims(claims map[string]interface{}) (*Identity, error) {
+	now := j.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("jwt has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(j.opts.Leeway)) {
+		return nil, errors.New("jwt has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt is not valid yet")
+	}
+	if j.opts.Issuer != "" && claims["iss"] != j.opts.Issuer {
+		return nil, fmt.Errorf("jwt issuer '%v' is not trusted", claims["iss"])
+	}
+	if j.opts.Audience != "" && !containsClaim(claims["aud"], j.opts.Audience) {
+		return nil, fmt.Errorf("jwt audience '%v' does not include '%v'", claims["aud"], j.opts.Audience)
+	}
+	user, ok := claims[j.opts.UserClaim].(string)
+	if !ok || user == "" {
+		return nil, fmt.Errorf("jwt has no '%v' claim for the username", j.opts.UserClaim)
+	}
+	id := &Identity{User: user, Method: "jwt", Scopes: jwtScopes(claims)}
+	id.Roles = scopeRoles(id.Scopes, j.opts.RoleScopePrefix)
+	if len(id.Roles) == 0 {
+		// tokens without chowder scopes are treated like users configured without roles
+		id.Roles = DefaultRoles
+	}
+	return id, nil
+}
+
+// jwtScopes reads the space separated scope claim (RFC 8693) or the scp claim used by some issuers
+func jwtScopes(claims map[string]interface{}) []string {
+	var scopes []string
+	for _, name := range []string{"scope", "scp"} {
+		switch v := claims[name].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(v)...)
+		case []interface{}:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+func containsClaim(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, c := range v {
+			if c == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(alg string, method jwtMethod, key crypto.PublicKey, signed, sig []byte) error {
+	var digest []byte
+	if method.hash != 0 {
+		h := method.hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, method.hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(k, method.hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("jwt signature has the wrong length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("jwt signature is invalid")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, signed, sig) {
+			return errors.New("jwt signature is invalid")
+		}
+		return nil
+	}
+	return errors.New("jwt key type is not supported")
+}
+
+// JWKS is a JSON Web Key Set loaded from a file or URL, reloaded in the background after a refresh
+// interval or synchronously (at most once a minute) when a token names a key it does not hold
+type JWKS struct {
+	location   string
+	refresh    time.Duration
+	client     *http.Client
+	mu         sync.RWMutex
+	keys       []jwk
+	next       time.Time
+	refreshing bool
+	lastForced time.Time
+	now        func() time.Time
+}
+
+// maxJWKSSize bounds the key set read from a URL
+const maxJWKSSize = 1 << 20
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	key crypto.PublicKey
+}
+
+// NewJWKS loads the key set at location, which is either a file path or an http(s) URL
+func NewJWKS(location string, refresh time.Duration) (*JWKS, error) {
+	j := &JWKS{
+		location: location,
+		refresh:  refresh,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Key returns the public key with the supplied id (or the only suitable key if kid is empty)
+func (j *JWKS) Key(kid, alg, kty string) (crypto.PublicKey, error) {
+	if j.refreshDue() {
+		go j.backgroundRefresh()
+	}
+	key, err := j.find(kid, alg, kty)
+	if err == errUnknownKey && j.forceRefresh() {
+		if err := j.load(); err != nil {
+			log.Warn().Err(err).Str("jwks", j.location).Msg("failed refreshing jwks, using cached keys")
+		}
+		return j.find(kid, alg, kty)
+	}
+	return key, err
+}
+
+// refreshDue claims the periodic refresh if it is due and no other request already has
+func (j *JWKS) refreshDue() bool {
+	if j.refresh <= 0 {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.refreshing || j.now().Before(j.next) {
+		return false
+	}
+	j.refreshing = true
+	return true
+}
+
+func (j *JWKS) backgroundRefresh() {
+	if err := j.load(); err != nil {
+		log.Warn().Err(err).Str("jwks", j.location).Msg("failed refreshing jwks, using cached keys")
+	}
+	j.mu.Lock()
+	j.refreshing = false
+	j.mu.Unlock()
+}
+
+// forceRefresh limits reloads for unknown key ids to one a minute so bogus tokens cannot hammer the source
+func (j *JWKS) forceRefresh() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.now().Sub(j.lastForced) < time.Minute {
+		return false
+	}
+	j.lastForced = j.now()
+	return true
+}
+
+func (j *JWKS) find(kid, alg, kty string) (crypto.PublicKey, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	var found *jwk
+	for i := range j.keys {
+		k := &j.keys[i]
+		if k.Kty != kty || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != alg) {
+			continue
+		}
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("jwt has no kid and several keys match")
+		}
+		found = k
+	}
+	if found == nil {
+		return nil, errUnknownKey
+	}
+	return found.key, nil
+}
+
+// load fetches the key set, scheduling the next periodic refresh after the interval on success or
+// after at most a minute on failure so that an unavailable issuer is not retried on every request
+func (j *JWKS) load() error {
+	keys, err := j.fetchKeys()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err != nil {
+		retry := time.Minute
+		if j.refresh > 0 && j.refresh < retry {
+			retry = j.refresh
+		}
+		j.next = j.now().Add(retry)
+		jwksRefreshes.WithLabelValues("error").Inc()
+		return err
+	}
+	j.keys = keys
+	j.next = j.now().Add(j.refresh)
+	jwksRefreshes.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (j *JWKS) fetchKeys() ([]jwk, error) {
+	b, err := j.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("could not load jwks: %v", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("could not parse jwks: %v", err)
+	}
+	keys := set.Keys[:0]
+	for _, k := range set.Keys {
+		if k.key, err = k.publicKey(); err != nil {
+			log.Warn().Err(err).Str("kid", k.Kid).Msg("skipping unusable jwk")
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	if !strings.HasPrefix(j.location, "https://") && !strings.HasPrefix(j.location, "http://") {
+		return ioutil.ReadFile(j.location)
+	}
+	resp, err := j.client.Get(j.location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxJWKSSize {
+		return nil, fmt.Errorf("jwks is larger than %v bytes", maxJWKSSize)
+	}
+	return b, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rsa modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%v'", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid ec point encoding")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("ec point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("only Ed25519 okp keys are supported")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%v'", k.Kty)
+}
@@ -0,0 +1,186 @@
+package chowder
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func testJWKS() []byte {
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(testRSAKey.N.Bytes()), "e": b64(big.NewInt(int64(testRSAKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(testECKey.X.Bytes()), "y": b64(testECKey.Y.Bytes())},
+		},
+	}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+func signTestJWT(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, testRSAKey, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		r, s, e := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+		err = e
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	assert.Nil(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func setupJWTTest(t *testing.T) *JWTAuth {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testJWKS())
+	}))
+	t.Cleanup(srv.Close)
+	keys, err := NewJWKS(srv.URL, time.Hour)
+	assert.Nil(t, err)
+	return NewJWTAuth(keys, JWTOptions{Issuer: "https://issuer", Audience: "chowder"})
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://issuer",
+		"aud":   []string{"other", "chowder"},
+		"sub":   "service-a",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "scan read",
+	}
+}
+
+func TestJWTAuthAcceptsValidTokens(t *testing.T) {
+	sut := setupJWTTest(t)
+
+	for alg, kid := range map[string]string{"RS256": "rsa", "PS256": "rsa", "ES256": "ec"} {
+		id, ok := sut.AuthenticateToken(signTestJWT(t, alg, kid, validClaims()))
+
+		assert.True(t, ok, alg)
+		assert.Equal(t, &Identity{User: "service-a", Method: "jwt", Scopes: []string{"scan", "read"}, Roles: DefaultRoles}, id)
+	}
+}
+
+func TestJWTAuthRejectsInvalidTokens(t *testing.T) {
+	sut := setupJWTTest(t)
+	modify := func(change func(map[string]interface{})) map[string]interface{} {
+		c := validClaims()
+		change(c)
+		return c
+	}
+	tampered := signTestJWT(t, "RS256", "rsa", validClaims())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	for name, token := range map[string]string{
+		"expired":     signTestJWT(t, "RS256", "rsa", modify(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"no exp":      signTestJWT(t, "RS256", "rsa", modify(func(c map[string]interface{}) { delete(c, "exp") })),
+		"not yet":     signTestJWT(t, "RS256", "rsa", modify(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() })),
+		"issuer":      signTestJWT(t, "RS256", "rsa", modify(func(c map[string]interface{}) { c["iss"] = "https://evil" })),
+		"audience":    signTestJWT(t, "RS256", "rsa", modify(func(c map[string]interface{}) { c["aud"] = "other" })),
+		"no user":     signTestJWT(t, "RS256", "rsa", modify(func(c map[string]interface{}) { delete(c, "sub") })),
+		"wrong key":   signTestJWT(t, "ES256", "rsa", validClaims()),
+		"unknown kid": signTestJWT(t, "RS256", "missing", validClaims()),
+		"tampered":    tampered,
+		"alg none":    base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + ".e30.",
+		"not a jwt":   "password",
+	} {
+		_, ok := sut.AuthenticateToken(token)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestJWTAuthMapsUserClaim(t *testing.T) {
+	sut := setupJWTTest(t)
+	sut.opts.UserClaim = "client_id"
+	claims := validClaims()
+	claims["client_id"] = "batch-job"
+
+	id, ok := sut.AuthenticateToken(signTestJWT(t, "RS256", "rsa", claims))
+
+	assert.True(t, ok)
+	assert.Equal(t, "batch-job", id.User)
+}
+
+func TestJWTAuthMapsPrefixedScopesToRoles(t *testing.T) {
+	sut := setupJWTTest(t)
+	for scope, want := range map[string][]string{
+		"openid profile":                  DefaultRoles,
+		"admin openid":                    DefaultRoles,
+		"openid chowder:reader":           {RoleReader},
+		"chowder:scanner chowder:unknown": {RoleScanner},
+		"chowder:admin":                   {RoleAdmin},
+	} {
+		claims := validClaims()
+		claims["scope"] = scope
+
+		id, ok := sut.AuthenticateToken(signTestJWT(t, "RS256", "rsa", claims))
+
+		assert.True(t, ok, scope)
+		assert.Equal(t, want, id.Roles, scope)
+	}
+}
+
+func TestJWKSRefreshesInBackgroundAndBacksOff(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			w.Write(testJWKS())
+			return
+		}
+		<-release
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	sut, err := NewJWKS(srv.URL, time.Hour)
+	assert.Nil(t, err)
+	now := time.Now()
+	sut.now = func() time.Time { return now }
+
+	now = now.Add(2 * time.Hour)
+	// the refresh is stuck behind the issuer but tokens are still checked against the cached keys
+	key, err := sut.Key("rsa", "RS256", "RSA")
+	assert.Nil(t, err)
+	assert.NotNil(t, key)
+	close(release)
+	assert.Eventually(t, func() bool {
+		sut.mu.RLock()
+		defer sut.mu.RUnlock()
+		return !sut.refreshing
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		_, err = sut.Key("rsa", "RS256", "RSA")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,230 @@
+package chowder
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chowder_throttled_total",
+	Help: "The total number of requests refused for exceeding a per user limit",
+}, []string{"user", "reason"})
+
+// Limits caps how much a single user may scan. In a users file a zero field inherits the
+// global default and a negative field removes that limit for the user.
+type Limits struct {
+	// Rate is the sustained number of requests per second
+	Rate float64 `yaml:"rate,omitempty"`
+	// Burst is the number of requests that may be made at once, defaulting to the rate
+	Burst float64 `yaml:"burst,omitempty"`
+	// Bytes is the sustained number of body bytes per second
+	Bytes float64 `yaml:"bytes,omitempty"`
+	// BytesBurst is the number of bytes that may be sent at once, defaulting to the byte rate
+	BytesBurst float64 `yaml:"bytesburst,omitempty"`
+	// Concurrent is the maximum number of scans in flight
+	Concurrent int `yaml:"concurrent,omitempty"`
+}
+
+// withDefaults fills the unset fields of l from defaults
+func (l *Limits) withDefaults(defaults Limits) Limits {
+	if l == nil {
+		return defaults
+	}
+	merged := *l
+	if merged.Rate == 0 {
+		merged.Rate, merged.Burst = defaults.Rate, defaults.Burst
+	}
+	if merged.Bytes == 0 {
+		merged.Bytes, merged.BytesBurst = defaults.Bytes, defaults.BytesBurst
+	}
+	if merged.Concurrent == 0 {
+		merged.Concurrent = defaults.Concurrent
+	}
+	return merged
+}
+
+// RateLimiter enforces per user Limits on the routes it wraps using token buckets
+type RateLimiter struct {
+	defaults  Limits
+	mu        sync.Mutex
+	users     map[string]*userLimiter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type userLimiter struct {
+	requests tokenBucket
+	bytes    tokenBucket
+	inflight int
+	lastUsed time.Time
+}
+
+// NewRateLimiter returns a RateLimiter applying defaults to users without their own limits
+func NewRateLimiter(defaults Limits) *RateLimiter {
+	return &RateLimiter{
+		defaults: defaults,
+		users:    make(map[string]*userLimiter),
+		now:      time.Now,
+	}
+}
+
+// Limit wraps a scan route, answering 429 with a Retry-After once the caller exceeds their request
+// rate, byte rate or concurrent scans. It is applied per route rather than to the whole router so that
+// health checks and metrics scrapes never count against a user's scans.
+func (rl *RateLimiter) Limit(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, limits := "", rl.defaults
+		if id := getIdentity(r.Context()); id != nil {
+			user, limits = id.User, id.Limits.withDefaults(rl.defaults)
+		}
+		u, reason, retry := rl.acquire(user, limits)
+		if reason != "" {
+			throttled.WithLabelValues(user, reason).Inc()
+			addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+				return l.Str("throttled", reason)
+			})
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusTooManyRequests),
+				Message: fmt.Sprintf("%v limit exceeded", reason),
+			}, http.StatusTooManyRequests)
+			return
+		}
+		defer rl.release(u)
+		if r.Body != nil && limits.Bytes > 0 {
+			r.Body = &meteredBody{ReadCloser: r.Body, limiter: rl, user: u}
+		}
+		handle(w, r, ps)
+	}
+}
+
+func (rl *RateLimiter) acquire(user string, limits Limits) (*userLimiter, string, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.sweep(now)
+	u, ok := rl.users[user]
+	if !ok {
+		u = &userLimiter{}
+		rl.users[user] = u
+	}
+	u.lastUsed = now
+	u.requests.configure(now, limits.Rate, limits.Burst)
+	u.bytes.configure(now, limits.Bytes, limits.BytesBurst)
+	if limits.Concurrent > 0 && u.inflight >= limits.Concurrent {
+		return nil, "concurrency", time.Second
+	}
+	// a user in byte debt from an earlier upload waits for it to be repaid
+	if wait := u.bytes.wait(now, 0); wait > 0 {
+		return nil, "bytes", wait
+	}
+	if wait := u.requests.wait(now, 1); wait > 0 {
+		return nil, "rate", wait
+	}
+	u.requests.take(1)
+	u.inflight++
+	return u, "", 0
+}
+
+func (rl *RateLimiter) release(u *userLimiter) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	u.inflight--
+}
+
+func (rl *RateLimiter) consume(u *userLimiter, n int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	u.bytes.refill(rl.now())
+	u.bytes.take(float64(n))
+}
+
+// sweep forgets idle users every few minutes so that limiters for departed JWT subjects do not accumulate
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < 5*time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for user, u := range rl.users {
+		if u.inflight == 0 && now.Sub(u.lastUsed) > 10*time.Minute {
+			delete(rl.users, user)
+		}
+	}
+}
+
+// meteredBody debits the bytes read from a request body from the user's byte bucket, which may go into
+// debt so that uploads of unknown length are never cut off part way through
+type meteredBody struct {
+	io.ReadCloser
+	limiter *RateLimiter
+	user    *userLimiter
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.consume(b.user, n)
+	}
+	return n, err
+}
+
+// tokenBucket refills at rate tokens per second up to burst, a non-positive rate is unlimited
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) configure(now time.Time, rate, burst float64) {
+	if burst <= 0 {
+		burst = math.Max(rate, 1)
+	}
+	if b.last.IsZero() || b.rate != rate || b.burst != burst {
+		if b.last.IsZero() {
+			b.tokens = burst
+		}
+		b.rate, b.burst = rate, burst
+		b.last = now
+	}
+	b.refill(now)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until n tokens (or, for n of 0, a positive balance) are available
+func (b *tokenBucket) wait(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	missing := n - b.tokens
+	if n == 0 && b.tokens < 0 {
+		missing = -b.tokens
+	}
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
@@ -0,0 +1,92 @@
+package chowder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupLimitTest(defaults Limits) (*RateLimiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	rl := NewRateLimiter(defaults)
+	rl.now = func() time.Time { return now }
+	return rl, &now
+}
+
+func limitedRequest(sut httprouter.Handle, id *Identity, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/scan", strings.NewReader(body))
+	if id != nil {
+		r = r.WithContext(setIdentity(r.Context(), id))
+	}
+	sut(rw, r, nil)
+	return rw
+}
+
+func readBody(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ioutil.ReadAll(r.Body)
+}
+
+func TestRateLimiterLimitsRequestRate(t *testing.T) {
+	rl, now := setupLimitTest(Limits{Rate: 1, Burst: 2})
+	sut := rl.Limit(readBody)
+	alice := &Identity{User: "alice"}
+
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, alice, "").Code)
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, alice, "").Code)
+	rw := limitedRequest(sut, alice, "")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.Equal(t, `{"message":"rate limit exceeded","error":"Too Many Requests"}`, rw.Body.String())
+	// other users have their own bucket
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, &Identity{User: "bob"}, "").Code)
+
+	*now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, alice, "").Code)
+}
+
+func TestRateLimiterUsesPerUserLimits(t *testing.T) {
+	rl, _ := setupLimitTest(Limits{Rate: 1})
+	sut := rl.Limit(readBody)
+	unlimited := &Identity{User: "batch", Limits: &Limits{Rate: -1}}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, limitedRequest(sut, unlimited, "").Code)
+	}
+}
+
+func TestRateLimiterLimitsBytes(t *testing.T) {
+	rl, now := setupLimitTest(Limits{Bytes: 10})
+	sut := rl.Limit(readBody)
+	alice := &Identity{User: "alice"}
+
+	// the upload is allowed to finish but leaves the user 20 bytes in debt
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, alice, strings.Repeat("a", 30)).Code)
+	rw := limitedRequest(sut, alice, "a")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("Retry-After"))
+
+	*now = now.Add(2 * time.Second)
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, alice, "a").Code)
+}
+
+func TestRateLimiterLimitsConcurrency(t *testing.T) {
+	rl, _ := setupLimitTest(Limits{Concurrent: 1})
+	alice := &Identity{User: "alice"}
+	var inner *httptest.ResponseRecorder
+	sut := rl.Limit(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		inner = limitedRequest(rl.Limit(readBody), alice, "")
+	})
+
+	assert.Equal(t, http.StatusOK, limitedRequest(sut, alice, "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, inner.Code)
+	assert.Equal(t, `{"message":"concurrency limit exceeded","error":"Too Many Requests"}`, inner.Body.String())
+	// the slot is released once the first scan completes
+	assert.Equal(t, http.StatusOK, limitedRequest(rl.Limit(readBody), alice, "").Code)
+}
@@ -0,0 +1,119 @@
+package chowder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// connServer tracks the connections of a server speaking a protocol other than HTTP so that it can be
+// shut down gracefully, closing idle connections and waiting for those answering a request
+type connServer struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closing  bool
+}
+
+// serve calls handle in a new goroutine for each connection accepted from l until the server closes
+func (s *connServer) serve(l net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.mu.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.closed() {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(c, false) {
+			c.Close()
+			continue
+		}
+		go handle(c)
+	}
+}
+
+// Shutdown stops accepting connections and closes idle ones, then waits for requests in progress to be
+// answered until ctx is done
+func (s *connServer) Shutdown(ctx context.Context) error {
+	s.close(false)
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		remaining := len(s.conns)
+		s.mu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			s.close(false)
+		}
+	}
+}
+
+// Close stops accepting connections and closes every connection, including those mid request
+func (s *connServer) Close() error {
+	s.close(true)
+	return nil
+}
+
+func (s *connServer) close(all bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c, active := range s.conns {
+		if all || !active {
+			c.Close()
+		}
+	}
+}
+
+func (s *connServer) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// track records whether c is answering a request, failing once the server is closing and c is idle
+func (s *connServer) track(c net.Conn, active bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing && !active {
+		return false
+	}
+	s.conns[c] = active
+	return true
+}
+
+// untrack closes c and forgets it
+func (s *connServer) untrack(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.Close()
+}
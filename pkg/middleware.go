@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,7 +13,14 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const logKey key = 0
+const (
+	logKey key = iota
+	identityKey
+	priorityKey
+	scanReportKey
+	urlBodyKey
+	s3BodyKey
+)
 
 var (
 	connCount = promauto.NewCounter(prometheus.CounterOpts{
@@ -46,6 +54,22 @@ func setLog(ctx context.Context, l *zerolog.Logger) context.Context {
 	return context.WithValue(ctx, logKey, l)
 }
 
+func getIdentity(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey).(*Identity)
+	return id
+}
+
+func setIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+func getUser(ctx context.Context) string {
+	if id := getIdentity(ctx); id != nil {
+		return id.User
+	}
+	return ""
+}
+
 func addLogFields(ctx context.Context, addFields func(zerolog.Context) zerolog.Context) {
 	oldLog := getLog(ctx)
 	newLog := addFields(oldLog.With()).Logger()
@@ -76,6 +100,18 @@ func (w *StatusWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Flush sends buffered data to the client, if the underlying ResponseWriter can, for streamed responses
+func (w *StatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter
+func (w *StatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // LogRequests logs all requests that pass through with loglevel dependant on status code
 func LogRequests(l zerolog.Logger, handler http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -147,32 +183,178 @@ func logLevelFromStatus(l zerolog.Logger, status int) *zerolog.Event {
 	}
 }
 
-// HeaderAuth enforces that users are authenticated by reading the Authorization header
-func HeaderAuth(users map[string]string, handler http.Handler) http.HandlerFunc {
-	if len(users) == 0 {
-		log.Warn().Msg("no users supplied, authentication is disabled")
-		return handler.ServeHTTP
+// Identity is an authenticated caller
+type Identity struct {
+	User string
+	// Method is how the caller authenticated, e.g. token, jwt or cert
+	Method string
+	// Roles are granted to the user by chowder's configuration
+	Roles []string
+	// Scopes are granted by the credential itself (e.g. a JWT scope claim)
+	Scopes []string
+	// Limits overrides the default per user limits if set
+	Limits *Limits
+	// Quota overrides the default per user quota if set
+	Quota *Quota
+	// Priority is the class the user's scans are admitted at
+	Priority Priority
+}
+
+// TokenAuthenticator resolves a bearer token to the Identity it belongs to
+type TokenAuthenticator interface {
+	// Enabled reports whether any credentials are configured
+	Enabled() bool
+	AuthenticateToken(token string) (*Identity, bool)
+}
+
+// Authenticators tries each TokenAuthenticator in turn, accepting the first that recognises a token
+type Authenticators []TokenAuthenticator
+
+// Enabled reports whether any of the authenticators are enabled
+func (as Authenticators) Enabled() bool {
+	for _, a := range as {
+		if a.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticateToken returns the Identity from the first enabled authenticator recognising token
+func (as Authenticators) AuthenticateToken(token string) (*Identity, bool) {
+	for _, a := range as {
+		if !a.Enabled() {
+			continue
+		}
+		if id, ok := a.AuthenticateToken(token); ok {
+			return id, true
+		}
+	}
+	return nil, false
+}
+
+// AuthOptions configures where HeaderAuth looks for tokens
+type AuthOptions struct {
+	// Realm is reported in WWW-Authenticate challenges
+	Realm string
+	// APIKeyHeader names an additional header (e.g. X-API-Key) that may carry a bare token
+	APIKeyHeader string
+	// AllowRawTokens accepts a bare token in the Authorization header, as chowder always has,
+	// in addition to the RFC 6750 `Authorization: Bearer <token>` form
+	AllowRawTokens bool
+	// Certificates authenticates verified TLS client certificates before any token is considered
+	Certificates *CertAuth
+	// PublicPaths are served without authentication, e.g. the probes an orchestrator has no token for
+	PublicPaths []string
+}
+
+// authFailure describes why a request could not be authenticated without repeating its token
+type authFailure struct {
+	status      int
+	code        string
+	description string
+}
+
+var (
+	errNoToken      = &authFailure{http.StatusUnauthorized, "", "no authorisation token supplied"}
+	errUnknownToken = &authFailure{http.StatusUnauthorized, "invalid_token", "token not recognised"}
+	errBadScheme    = &authFailure{http.StatusUnauthorized, "", "authorisation scheme not supported, use Bearer"}
+	errBadBearer    = &authFailure{http.StatusBadRequest, "invalid_request", "malformed Bearer authorisation"}
+)
+
+// HeaderAuth enforces that users are authenticated by reading the Authorization header (or API key header).
+// Authentication is disabled while no credentials are configured, which is checked on every request so
+// that users loaded by a later reload are enforced immediately.
+func HeaderAuth(auth TokenAuthenticator, opts AuthOptions, handler http.Handler) http.HandlerFunc {
+	if !auth.Enabled() && opts.Certificates == nil {
+		log.Warn().Msg("no users supplied, authentication is disabled until users are loaded")
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		t := r.Header.Get("Authorization")
-		user, ok := users[t]
-		if !ok {
+		if (!auth.Enabled() && opts.Certificates == nil) || opts.public(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		id, failure := opts.authenticate(auth, r)
+		if failure != nil {
+			addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+				return l.Str("auth-failure", failure.description)
+			})
+			w.Header().Set("WWW-Authenticate", opts.challenge(failure))
 			writeResponse(w, r, &Response{
-				Error:   http.StatusText(http.StatusUnauthorized),
-				Message: getAuthFailureMessage(t),
-			}, http.StatusUnauthorized)
+				Error:   http.StatusText(failure.status),
+				Message: failure.description,
+			}, failure.status)
 			return
 		}
 		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
-			return l.Str("user", user)
+			return l.Str("user", id.User).Str("auth-method", id.Method)
 		})
-		handler.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r.WithContext(setIdentity(r.Context(), id)))
+	}
+}
+
+func (opts AuthOptions) public(r *http.Request) bool {
+	if r.URL == nil {
+		return false
+	}
+	for _, p := range opts.PublicPaths {
+		if r.URL.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate identifies the caller by client certificate or else by token
+func (opts AuthOptions) authenticate(auth TokenAuthenticator, r *http.Request) (*Identity, *authFailure) {
+	if id, ok := opts.Certificates.AuthenticateRequest(r); ok {
+		return id, nil
+	}
+	t, failure := opts.token(r)
+	if failure != nil {
+		return nil, failure
+	}
+	id, ok := auth.AuthenticateToken(t)
+	if !ok {
+		return nil, errUnknownToken
+	}
+	return id, nil
+}
+
+// token extracts the credential from the request, never including it in a failure
+func (opts AuthOptions) token(r *http.Request) (string, *authFailure) {
+	h := strings.TrimSpace(r.Header.Get("Authorization"))
+	if h == "" {
+		if opts.APIKeyHeader != "" {
+			if t := strings.TrimSpace(r.Header.Get(opts.APIKeyHeader)); t != "" {
+				return t, nil
+			}
+		}
+		return "", errNoToken
 	}
+	i := strings.IndexByte(h, ' ')
+	if i < 0 || !strings.EqualFold(h[:i], "Bearer") {
+		// any other value was a valid raw token before Bearer support, spaces included
+		if opts.AllowRawTokens {
+			return h, nil
+		}
+		return "", errBadScheme
+	}
+	t := strings.TrimSpace(h[i+1:])
+	if t == "" || strings.ContainsAny(t, " \t") {
+		return "", errBadBearer
+	}
+	return t, nil
 }
 
-func getAuthFailureMessage(t string) string {
-	if t == "" {
-		return "no authorisation token supplied"
+func (opts AuthOptions) challenge(failure *authFailure) string {
+	realm := opts.Realm
+	if realm == "" {
+		realm = "chowder"
+	}
+	c := fmt.Sprintf("Bearer realm=%q", realm)
+	if failure.code != "" {
+		c += fmt.Sprintf(", error=%q, error_description=%q", failure.code, failure.description)
 	}
-	return fmt.Sprintf("token '%v' not recognised", t)
+	return c
 }
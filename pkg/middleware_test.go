@@ -3,7 +3,11 @@ package chowder
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -54,12 +58,14 @@ func TestAuthMiddlewareAllowsValidAuth(t *testing.T) {
 		},
 	}
 	m := &mockHandler{}
-	m.On("ServeHTTP", rw, r).Once()
-	u := map[string]string{
-		"password": "user",
-	}
+	m.On("ServeHTTP", rw, mock.MatchedBy(func(req *http.Request) bool {
+		return getUser(req.Context()) == "user"
+	})).Once()
+	u, _ := NewUsers(map[string]UserEntry{
+		"password": {User: "user"},
+	})
 
-	sut := HeaderAuth(u, m)
+	sut := HeaderAuth(u, AuthOptions{AllowRawTokens: true}, m)
 	sut.ServeHTTP(rw, r)
 
 	rw.AssertExpectations(t)
@@ -70,7 +76,7 @@ func TestAuthMiddlewareBlocksInvalidAuth(t *testing.T) {
 	rw := &mockResponseWriter{}
 	rw.Mock.On("WriteHeader", 401).Once()
 	h := http.Header{}
-	rw.Mock.On("Header").Once().Return(h)
+	rw.Mock.On("Header").Twice().Return(h)
 	resp := ""
 	rw.Mock.On("Write", mock.Anything).Once().Run(func(args mock.Arguments) {
 		asByte, ok := args.Get(0).([]byte)
@@ -84,23 +90,24 @@ func TestAuthMiddlewareBlocksInvalidAuth(t *testing.T) {
 			"Authorization": []string{"notpassword"},
 		}}
 	m := &mockHandler{}
-	u := map[string]string{
-		"password": "user",
-	}
+	u, _ := NewUsers(map[string]UserEntry{
+		"password": {User: "user"},
+	})
 
-	sut := HeaderAuth(u, m)
+	sut := HeaderAuth(u, AuthOptions{AllowRawTokens: true}, m)
 	sut.ServeHTTP(rw, r)
 
 	rw.AssertExpectations(t)
 	m.AssertExpectations(t)
-	assert.Equal(t, `{"message":"token 'notpassword' not recognised","error":"Unauthorized"}`, resp)
+	assert.Equal(t, `{"message":"token not recognised","error":"Unauthorized"}`, resp)
+	assert.Equal(t, `Bearer realm="chowder", error="invalid_token", error_description="token not recognised"`, h.Get("WWW-Authenticate"))
 }
 
 func TestAuthMiddlewareBlocksNoAuthSupplied(t *testing.T) {
 	rw := &mockResponseWriter{}
 	rw.Mock.On("WriteHeader", 401).Once()
 	h := http.Header{}
-	rw.Mock.On("Header").Once().Return(h)
+	rw.Mock.On("Header").Twice().Return(h)
 	resp := ""
 	rw.Mock.On("Write", mock.Anything).Once().Run(func(args mock.Arguments) {
 		asByte, ok := args.Get(0).([]byte)
@@ -111,16 +118,127 @@ func TestAuthMiddlewareBlocksNoAuthSupplied(t *testing.T) {
 	}).Return(0, nil)
 	r := &http.Request{}
 	m := &mockHandler{}
-	u := map[string]string{
-		"password": "user",
-	}
+	u, _ := NewUsers(map[string]UserEntry{
+		"password": {User: "user"},
+	})
 
-	sut := HeaderAuth(u, m)
+	sut := HeaderAuth(u, AuthOptions{AllowRawTokens: true}, m)
 	sut.ServeHTTP(rw, r)
 
 	rw.AssertExpectations(t)
 	m.AssertExpectations(t)
 	assert.Equal(t, `{"message":"no authorisation token supplied","error":"Unauthorized"}`, resp)
+	assert.Equal(t, `Bearer realm="chowder"`, h.Get("WWW-Authenticate"))
+}
+
+func TestAuthMiddlewareAcceptsBearerAndAPIKey(t *testing.T) {
+	u, _ := NewUsers(map[string]UserEntry{
+		"password": {User: "user"},
+	})
+	opts := AuthOptions{APIKeyHeader: "X-API-Key"}
+	for _, h := range []http.Header{
+		{"Authorization": []string{"Bearer password"}},
+		{"Authorization": []string{"bearer  password"}},
+		{"X-Api-Key": []string{"password"}},
+	} {
+		rw := &mockResponseWriter{}
+		r := &http.Request{Header: h}
+		m := &mockHandler{}
+		m.On("ServeHTTP", rw, mock.MatchedBy(func(req *http.Request) bool {
+			return getUser(req.Context()) == "user"
+		})).Once()
+
+		HeaderAuth(u, opts, m).ServeHTTP(rw, r)
+
+		m.AssertExpectations(t)
+	}
+}
+
+func TestAuthMiddlewareAcceptsRawTokensWithSpaces(t *testing.T) {
+	u, _ := NewUsers(map[string]UserEntry{
+		"correct horse battery staple": {User: "user"},
+	})
+	rw := &mockResponseWriter{}
+	r := &http.Request{Header: http.Header{"Authorization": []string{"correct horse battery staple"}}}
+	m := &mockHandler{}
+	m.On("ServeHTTP", rw, mock.MatchedBy(func(req *http.Request) bool {
+		return getUser(req.Context()) == "user"
+	})).Once()
+
+	HeaderAuth(u, AuthOptions{AllowRawTokens: true}, m).ServeHTTP(rw, r)
+
+	m.AssertExpectations(t)
+}
+
+func TestAuthMiddlewareRejectsUnsupportedAuth(t *testing.T) {
+	u, _ := NewUsers(map[string]UserEntry{
+		"password": {User: "user"},
+	})
+	for header, want := range map[string]int{
+		"password":              401,
+		"Basic cGFzc3dvcmQ=":    401,
+		"Bearer":                401,
+		"Bearer pass word":      400,
+		"Bearer notpassword":    401,
+		"Bearer    ":            401,
+		"Bearer password extra": 400,
+	} {
+		rw := httptest.NewRecorder()
+		r := &http.Request{Header: http.Header{"Authorization": []string{header}}}
+		m := &mockHandler{}
+
+		HeaderAuth(u, AuthOptions{}, m).ServeHTTP(rw, r)
+
+		m.AssertExpectations(t)
+		assert.Equal(t, want, rw.Code, header)
+		assert.NotContains(t, rw.Body.String(), "password", header)
+		assert.Contains(t, rw.Header().Get("WWW-Authenticate"), `Bearer realm="chowder"`, header)
+	}
+}
+
+func TestAuthMiddlewareEnforcesUsersLoadedLater(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yml")
+	u, err := LoadUsers(path)
+	assert.Nil(t, err)
+	m := &mockHandler{}
+	m.On("ServeHTTP", mock.Anything, mock.Anything).Once()
+	sut := HeaderAuth(u, AuthOptions{}, m)
+
+	// no users yet so authentication is disabled
+	rw := httptest.NewRecorder()
+	sut.ServeHTTP(rw, &http.Request{})
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("password: user\n"), 0600))
+	changed, err := u.Reload()
+	assert.True(t, changed)
+	assert.Nil(t, err)
+	rw = httptest.NewRecorder()
+	sut.ServeHTTP(rw, &http.Request{})
+
+	m.AssertExpectations(t)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestAuthMiddlewareServesPublicPaths(t *testing.T) {
+	u, _ := NewUsers(map[string]UserEntry{
+		"password": {User: "user"},
+	})
+	m := &mockHandler{}
+	m.On("ServeHTTP", mock.Anything, mock.Anything).Once()
+	sut := HeaderAuth(u, AuthOptions{PublicPaths: []string{"/readyz"}}, m)
+
+	rw := httptest.NewRecorder()
+	sut.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	rw = httptest.NewRecorder()
+	sut.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/readyz/other", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	m.AssertExpectations(t)
 }
 
 type mockHandler struct {
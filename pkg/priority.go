@@ -0,0 +1,142 @@
+package chowder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// Priority is the class a scan waits for admission in, the zero value is PriorityNormal
+type Priority int
+
+const (
+	// PriorityNormal is the default priority
+	PriorityNormal Priority = iota
+	// PriorityHigh is for interactive scans that someone is waiting on
+	PriorityHigh
+	// PriorityLow is for background work such as re-scans
+	PriorityLow
+	priorities = 3
+)
+
+// DefaultPriorityWeights are the shares of freed scan slots given to normal, high and low priority scans
+var DefaultPriorityWeights = [priorities]int{PriorityNormal: 3, PriorityHigh: 6, PriorityLow: 1}
+
+// ParsePriority parses high, normal or low
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "normal", "":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("priority '%v' must be one of high, normal or low", s)
+}
+
+// rank orders priorities from low to high
+func (p Priority) rank() int {
+	switch p {
+	case PriorityHigh:
+		return 2
+	case PriorityLow:
+		return 0
+	}
+	return 1
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// UnmarshalYAML reads a priority by name
+func (p *Priority) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := ParsePriority(s)
+	*p = parsed
+	return err
+}
+
+// MarshalYAML writes a priority by name
+func (p Priority) MarshalYAML() (interface{}, error) {
+	return p.String(), nil
+}
+
+func getPriority(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey).(Priority)
+	return p
+}
+
+// WithPriority returns a context that scans are admitted from at priority p
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey, p)
+}
+
+// PriorityPolicy decides the priority of each scan request
+type PriorityPolicy struct {
+	// Header may carry a priority overriding the caller's own, e.g. X-Chowder-Priority
+	Header string
+	// Roles are allowed to use the header, callers without one are refused with 403
+	Roles []string
+}
+
+// Apply wraps a scan route, admitting it at the priority from the policy header or else the caller's configured priority
+func (pp PriorityPolicy) Apply(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id := getIdentity(r.Context())
+		priority := PriorityNormal
+		if id != nil {
+			priority = id.Priority
+		}
+		if h := r.Header.Get(pp.Header); pp.Header != "" && h != "" {
+			requested, err := ParsePriority(h)
+			if err != nil {
+				writeResponse(w, r, &Response{
+					Error:   http.StatusText(http.StatusBadRequest),
+					Message: err.Error(),
+				}, http.StatusBadRequest)
+				return
+			}
+			if !pp.allowed(id) {
+				accessDenied.WithLabelValues("priority").Inc()
+				writeResponse(w, r, &Response{
+					Error:   http.StatusText(http.StatusForbidden),
+					Message: fmt.Sprintf("setting %v requires one of the roles %v", pp.Header, strings.Join(pp.Roles, ", ")),
+				}, http.StatusForbidden)
+				return
+			}
+			priority = requested
+		}
+		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+			return l.Str("priority", priority.String())
+		})
+		handle(w, r.WithContext(WithPriority(r.Context(), priority)), ps)
+	}
+}
+
+func (pp PriorityPolicy) allowed(id *Identity) bool {
+	if id == nil {
+		// authentication is disabled
+		return true
+	}
+	for _, role := range pp.Roles {
+		if id.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package chowder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionServesHighPriorityFirstWithoutStarvingLow(t *testing.T) {
+	sut := NewAdmission(1, 100, time.Minute)
+	release, _ := sut.Acquire(context.Background())
+	var mu sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	for i, p := range []Priority{PriorityLow, PriorityLow, PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh, PriorityNormal} {
+		wg.Add(1)
+		go func(p Priority) {
+			defer wg.Done()
+			r, err := sut.Acquire(WithPriority(context.Background(), p))
+			assert.Nil(t, err)
+			mu.Lock()
+			order = append(order, p)
+			mu.Unlock()
+			r()
+		}(p)
+		queued := i + 1
+		assert.Eventually(t, func() bool {
+			sut.mu.Lock()
+			defer sut.mu.Unlock()
+			return sut.queued == queued
+		}, time.Second, time.Millisecond)
+	}
+
+	release()
+	wg.Wait()
+
+	assert.Len(t, order, 10)
+	assert.Equal(t, PriorityHigh, order[0])
+	assert.Contains(t, order[:7], PriorityLow)
+	assert.Contains(t, order[:7], PriorityNormal)
+}
+
+func TestPriorityPolicyAppliesUserAndHeaderPriority(t *testing.T) {
+	sut := PriorityPolicy{Header: "X-Chowder-Priority", Roles: []string{RoleAdmin}}
+	var seen Priority
+	handle := sut.Apply(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		seen = getPriority(r.Context())
+	})
+	request := func(id *Identity, header string) int {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		if header != "" {
+			r.Header.Set("X-Chowder-Priority", header)
+		}
+		if id != nil {
+			r = r.WithContext(setIdentity(r.Context(), id))
+		}
+		seen = -1
+		handle(rw, r, nil)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(&Identity{User: "batch", Priority: PriorityLow}, ""))
+	assert.Equal(t, PriorityLow, seen)
+	assert.Equal(t, http.StatusOK, request(&Identity{User: "root", Roles: []string{RoleAdmin}}, "high"))
+	assert.Equal(t, PriorityHigh, seen)
+	assert.Equal(t, http.StatusForbidden, request(&Identity{User: "batch", Roles: DefaultRoles}, "high"))
+	assert.Equal(t, Priority(-1), seen)
+	assert.Equal(t, http.StatusBadRequest, request(&Identity{User: "root", Roles: []string{RoleAdmin}}, "urgent"))
+	assert.Equal(t, http.StatusOK, request(nil, "low"))
+	assert.Equal(t, PriorityLow, seen)
+}
@@ -2,13 +2,29 @@ package chowder
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	scansInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chowder_scans_inflight",
+		Help: "The number of scans currently in progress",
+	})
+	draining = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chowder_draining",
+		Help: "Whether chowder is draining connections before shutting down",
+	})
+)
+
 // ScanResponse is a response with the result of a scan
 type ScanResponse struct {
 	Infected bool `json:"infected"`
@@ -18,12 +34,61 @@ type ScanResponse struct {
 // Proxy is a http proxy for a VirusScanner
 type Proxy struct {
 	AntiVirus VirusScanner
+	Audit     *AuditLog
+	Admission *Admission
+	Health    *HealthMonitor
+	// BatchConcurrency is how many entries of a batch are scanned at once, DefaultBatchConcurrency if not positive
+	BatchConcurrency int
+	// BatchEntrySize bounds the entries of a batch, DefaultBatchEntrySize if not positive
+	BatchEntrySize int64
+	// Fetcher fetches content for scans by URL, which are not enabled if nil
+	Fetcher *URLFetcher
+	// S3 scans objects in object storage, which is not enabled if nil
+	S3       *S3Scanner
+	draining int32
+	inflight int64
 }
 
 // Scan performs an scan on the body of the request
 func (p *Proxy) Scan(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Debug().Msg("received scan request")
-	infected, msg, err := p.AntiVirus.Scan(r.Body)
+	infected, msg, ok := p.scan(w, r, func() (io.ReadCloser, error) {
+		return r.Body, nil
+	})
+	if ok {
+		writeScanResponse(w, r, infected, msg)
+	}
+}
+
+func writeScanResponse(w http.ResponseWriter, r *http.Request, infected bool, msg string) {
+	writeResponse(w, r, &ScanResponse{
+		Infected: infected,
+		Response: Response{
+			Message: msg,
+		}}, http.StatusOK)
+}
+
+// scan scans the stream returned by open once the scan is admitted, answering with an *httpError's
+// status if open fails. It answers failures itself, leaving the caller to answer a completed scan.
+func (p *Proxy) scan(w http.ResponseWriter, r *http.Request, open func() (io.ReadCloser, error)) (infected bool, msg string, ok bool) {
+	infected, msg, err := p.scanAdmitted(r, open)
+	if e, isHTTP := err.(*httpError); isHTTP {
+		if e.status == http.StatusServiceUnavailable {
+			addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+				return l.Str("admission", e.msg)
+			})
+			w.Header().Set("Retry-After", strconv.Itoa(int(p.Admission.RetryAfter().Seconds())))
+		} else {
+			addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+				return l.Err(err)
+			})
+		}
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(e.status),
+			Message: e.msg,
+		}, e.status)
+		return false, "", false
+	}
 	if err != nil {
 		writeResponse(w, r, &Response{
 			Message: msg,
@@ -32,43 +97,116 @@ func (p *Proxy) Scan(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
 			return l.Str("daemon-response", msg).Err(err)
 		})
-		return
+		return false, "", false
 	}
+	reportScanned(r.Context())
 	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
 		return l.Str("daemon-response", msg).Bool("infected", infected)
 	})
-	writeResponse(w, r, &ScanResponse{
-		Infected: infected,
-		Response: Response{
-			Message: msg,
-		}}, http.StatusOK)
+	return infected, msg, true
+}
+
+// scanAdmitted scans the stream returned by open once the scan is admitted, auditing the outcome. Being
+// turned away by admission is a 503 *httpError and open's errors are returned as they are.
+func (p *Proxy) scanAdmitted(r *http.Request, open func() (io.ReadCloser, error)) (bool, string, error) {
+	release, err := p.Admission.Acquire(r.Context())
+	if err != nil {
+		return false, "", &httpError{status: http.StatusServiceUnavailable, msg: err.Error()}
+	}
+	defer release()
+	atomic.AddInt64(&p.inflight, 1)
+	scansInflight.Inc()
+	defer func() {
+		atomic.AddInt64(&p.inflight, -1)
+		scansInflight.Dec()
+	}()
+	body, err := open()
+	if err != nil {
+		return false, "", err
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	infected, msg, err := p.AntiVirus.Scan(body)
+	p.auditScan(r, infected, msg, err)
+	return infected, msg, err
 }
 
 // Ok returns a response to a healthz request
 func (p *Proxy) Ok(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Debug().Msg("received health request")
+	status, resp := p.pingStatus(r)
+	writeResponse(w, r, resp, status)
+}
+
+// pingStatus pings the antivirus unless draining, returning the status and response to answer a health check with
+func (p *Proxy) pingStatus(r *http.Request) (int, *Response) {
+	if p.Draining() {
+		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+			return l.Bool("draining", true)
+		})
+		return http.StatusServiceUnavailable, &Response{
+			Message: "Draining",
+		}
+	}
 	ok, msg, err := p.AntiVirus.Ok()
 	if err != nil {
 		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
 			return l.Bool("ok", ok).Str("daemon-response", msg).Err(err)
 		})
-		writeResponse(w, r, &Response{
+		return http.StatusInternalServerError, &Response{
 			Message: "Down",
 			Error:   fmt.Sprintf("%v - daemon response: %v", err.Error(), msg),
-		}, http.StatusInternalServerError)
-		return
+		}
 	}
 	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
 		return l.Bool("ok", ok).Str("daemon-response", msg)
 	})
 	if !ok {
-		writeResponse(w, r, &Response{
+		return http.StatusInternalServerError, &Response{
 			Message: "Down",
 			Error:   msg,
-		}, http.StatusInternalServerError)
-		return
+		}
 	}
-	writeResponse(w, r, &Response{
+	return http.StatusOK, &Response{
 		Message: "Up",
-	}, http.StatusOK)
+	}
+}
+
+// Drain fails health checks from now on so that load balancers stop sending new scans
+func (p *Proxy) Drain() {
+	atomic.StoreInt32(&p.draining, 1)
+	draining.Set(1)
+}
+
+// Draining reports whether Drain has been called
+func (p *Proxy) Draining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// Inflight returns the number of scans currently in progress
+func (p *Proxy) Inflight() int64 {
+	return atomic.LoadInt64(&p.inflight)
+}
+
+func (p *Proxy) auditScan(r *http.Request, infected bool, msg string, scanErr error) {
+	rec := AuditRecord{
+		Kind:   AuditKindScan,
+		User:   getUser(r.Context()),
+		Remote: r.RemoteAddr,
+		Action: "scan",
+		Detail: msg,
+	}
+	switch {
+	case scanErr != nil:
+		rec.Outcome = "error"
+		rec.Detail = scanErr.Error()
+	case infected:
+		rec.Outcome = "infected"
+	default:
+		rec.Outcome = "clean"
+	}
+	if err := p.Audit.Record(rec); err != nil {
+		getLog(r.Context()).Error().Err(err).Msg("failed writing audit record")
+	}
 }
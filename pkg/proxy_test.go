@@ -1,10 +1,14 @@
 package chowder
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/stretchr/testify/assert"
@@ -33,7 +37,7 @@ func TestScanValidCreatesCorrectResponse(t *testing.T) {
 	rw, r, mav, resp := setupProxyTest(200)
 	mav.On("Scan", nil).Return(false, "ok", nil)
 
-	sut := &Proxy{mav}
+	sut := &Proxy{AntiVirus: mav}
 
 	sut.Scan(rw, r, httprouter.Params{})
 
@@ -46,7 +50,7 @@ func TestScanErrCreatesCorrectResponse(t *testing.T) {
 	rw, r, mav, resp := setupProxyTest(500)
 	mav.On("Scan", nil).Return(false, "", errors.New("big badda boom"))
 
-	sut := &Proxy{mav}
+	sut := &Proxy{AntiVirus: mav}
 
 	sut.Scan(rw, r, httprouter.Params{})
 
@@ -55,11 +59,58 @@ func TestScanErrCreatesCorrectResponse(t *testing.T) {
 	assert.Equal(t, `{"error":"big badda boom"}`, *resp)
 }
 
+func TestScanReportsOnlySuccessfulScans(t *testing.T) {
+	for _, scanErr := range []error{nil, errors.New("big badda boom")} {
+		mav := &mockAntiVirus{}
+		mav.On("Scan", mock.Anything).Return(false, "ok", scanErr)
+		report := &scanReport{}
+		r := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		r = r.WithContext(context.WithValue(r.Context(), scanReportKey, report))
+
+		(&Proxy{AntiVirus: mav}).Scan(httptest.NewRecorder(), r, nil)
+
+		assert.Equal(t, scanErr == nil, report.scans == 1, scanErr)
+	}
+}
+
+func TestScanOverloadedCreatesCorrectResponse(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	mav := &mockAntiVirus{}
+
+	sut := &Proxy{AntiVirus: mav, Admission: NewAdmission(0, 0, 5*time.Second)}
+
+	sut.Scan(rw, r, httprouter.Params{})
+
+	mav.AssertExpectations(t)
+	assert.Equal(t, 503, rw.Code)
+	assert.Equal(t, "5", rw.Header().Get("Retry-After"))
+	assert.Equal(t, `{"message":"scanner is at capacity, retry later","error":"Service Unavailable"}`, rw.Body.String())
+}
+
+func TestScanWritesAuditRecord(t *testing.T) {
+	rw, r, mav, _ := setupProxyTest(200)
+	mav.On("Scan", nil).Return(true, "stream: Eicar-Signature FOUND", nil)
+	r = r.WithContext(setIdentity(r.Context(), &Identity{User: "user"}))
+	trail := &strings.Builder{}
+
+	sut := &Proxy{AntiVirus: mav, Audit: NewAuditLog(trail, 0, "")}
+
+	sut.Scan(rw, r, httprouter.Params{})
+
+	v := &AuditVerifier{}
+	assert.Nil(t, v.Verify(strings.NewReader(trail.String())))
+	assert.Equal(t, 1, v.Records)
+	assert.Equal(t, "user", v.First.User)
+	assert.Equal(t, "infected", v.First.Outcome)
+	assert.Equal(t, "stream: Eicar-Signature FOUND", v.First.Detail)
+}
+
 func TestOkValidCreatesCorrectResponse(t *testing.T) {
 	rw, r, mav, resp := setupProxyTest(200)
 	mav.On("Ok").Return(true, "ok", nil)
 
-	sut := &Proxy{mav}
+	sut := &Proxy{AntiVirus: mav}
 
 	sut.Ok(rw, r, httprouter.Params{})
 
@@ -72,7 +123,7 @@ func TestOkAntivirusDownCreatesCorrectResponse(t *testing.T) {
 	rw, r, mav, resp := setupProxyTest(500)
 	mav.On("Ok").Return(false, "", nil)
 
-	sut := &Proxy{mav}
+	sut := &Proxy{AntiVirus: mav}
 
 	sut.Ok(rw, r, httprouter.Params{})
 
@@ -85,7 +136,7 @@ func TestOkErrCreatesCorrectResponse(t *testing.T) {
 	rw, r, mav, resp := setupProxyTest(500)
 	mav.On("Ok").Return(false, "", errors.New("big badda boom"))
 
-	sut := &Proxy{mav}
+	sut := &Proxy{AntiVirus: mav}
 
 	sut.Ok(rw, r, httprouter.Params{})
 
@@ -94,6 +145,19 @@ func TestOkErrCreatesCorrectResponse(t *testing.T) {
 	assert.Equal(t, `{"message":"Down","error":"big badda boom - daemon response: "}`, *resp)
 }
 
+func TestOkDrainingCreatesCorrectResponse(t *testing.T) {
+	rw, r, mav, resp := setupProxyTest(503)
+
+	sut := &Proxy{AntiVirus: mav}
+	sut.Drain()
+
+	sut.Ok(rw, r, httprouter.Params{})
+
+	rw.AssertExpectations(t)
+	mav.AssertNotCalled(t, "Ok")
+	assert.Equal(t, `{"message":"Draining"}`, *resp)
+}
+
 type mockAntiVirus struct {
 	mock.Mock
 }
@@ -0,0 +1,290 @@
+package chowder
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReportFormats are the formats a Report can be written in
+var ReportFormats = []string{"text", "json", "junit", "sarif"}
+
+var reportContentTypes = map[string]string{
+	"text":  "text/plain; charset=utf-8",
+	"json":  "application/json",
+	"junit": "application/xml",
+	"sarif": "application/sarif+json",
+}
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+// ReportSummary counts the outcomes in a Report
+type ReportSummary struct {
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	Clean    int   `json:"clean"`
+	Infected int   `json:"infected"`
+	Errors   int   `json:"errors"`
+	// Duration is the wall clock time taken, not the sum of the scans
+	Duration time.Duration `json:"-"`
+}
+
+// Report is the outcome of scanning many files
+type Report struct {
+	Results []FileResult  `json:"results"`
+	Summary ReportSummary `json:"summary"`
+}
+
+// NewReport summarises the results of scans taking duration
+func NewReport(results []FileResult, duration time.Duration) *Report {
+	r := &Report{Results: results, Summary: ReportSummary{Files: len(results), Duration: duration}}
+	if r.Results == nil {
+		r.Results = []FileResult{}
+	}
+	for _, f := range results {
+		r.Summary.Bytes += f.Size
+		switch {
+		case f.Error != "":
+			r.Summary.Errors++
+		case f.Infected:
+			r.Summary.Infected++
+		default:
+			r.Summary.Clean++
+		}
+	}
+	return r
+}
+
+// Write writes the report in format, one of ReportFormats
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		return r.WriteText(w)
+	case "json":
+		return r.WriteJSON(w)
+	case "junit":
+		return r.WriteJUnit(w)
+	case "sarif":
+		return r.WriteSARIF(w)
+	}
+	return fmt.Errorf("unknown report format '%v'", format)
+}
+
+// WriteText writes a line per file in the style of clamscan followed by a summary
+func (r *Report) WriteText(w io.Writer) error {
+	for _, f := range r.Results {
+		var err error
+		switch {
+		case f.Error != "":
+			_, err = fmt.Fprintf(w, "%v: %v ERROR\n", f.Path, f.Error)
+		case f.Infected:
+			_, err = fmt.Fprintf(w, "%v: %v FOUND\n", f.Path, f.Signature)
+		default:
+			_, err = fmt.Fprintf(w, "%v: OK\n", f.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s := r.Summary
+	_, err := fmt.Fprintf(w, "\n----------- SCAN SUMMARY -----------\nScanned files: %v\nScanned bytes: %v\nInfected files: %v\nErrors: %v\nTime: %v\n",
+		s.Files, s.Bytes, s.Infected, s.Errors, s.Duration.Round(time.Millisecond))
+	return err
+}
+
+// WriteJSON writes the report as a json document
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML with a testcase per file, failed if the file is infected
+// and errored if it could not be scanned
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suite := junitSuite{
+		Name:     "chowder",
+		Tests:    r.Summary.Files,
+		Failures: r.Summary.Infected,
+		Errors:   r.Summary.Errors,
+		Time:     seconds(r.Summary.Duration),
+		Cases:    make([]junitCase, 0, len(r.Results)),
+	}
+	for _, f := range r.Results {
+		c := junitCase{Name: f.Path, ClassName: "chowder.scan", Time: seconds(f.Duration)}
+		switch {
+		case f.Error != "":
+			c.Error = &junitProblem{Message: f.Error}
+		case f.Infected:
+			c.Failure = &junitProblem{Message: f.Signature + " FOUND", Type: f.Signature, Text: f.Message}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitSuites{Suites: []junitSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful bool                `json:"executionSuccessful"`
+	Notifications       []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+// WriteSARIF writes the report as a SARIF 2.1.0 log with a rule per signature found and a result per
+// infected file. Files that could not be scanned are reported as tool execution notifications.
+func (r *Report) WriteSARIF(w io.Writer) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "chowder",
+			Version:        buildVersion(),
+			InformationURI: "https://github.com/lachlanmunro/chowder",
+			Rules:          []sarifRule{},
+		}},
+		Invocations: []sarifInvocation{{ExecutionSuccessful: r.Summary.Errors == 0}},
+		Results:     []sarifResult{},
+	}
+	rules := map[string]int{}
+	for _, f := range r.Results {
+		switch {
+		case f.Error != "":
+			run.Invocations[0].Notifications = append(run.Invocations[0].Notifications, sarifNotification{
+				Level:     "error",
+				Message:   sarifMessage{Text: f.Error},
+				Locations: []sarifLocation{sarifPath(f.Path)},
+			})
+		case f.Infected:
+			i, ok := rules[f.Signature]
+			if !ok {
+				i = len(run.Tool.Driver.Rules)
+				rules[f.Signature] = i
+				run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+					ID:               f.Signature,
+					ShortDescription: sarifMessage{Text: "Malware matching the " + f.Signature + " signature"},
+				})
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    f.Signature,
+				RuleIndex: i,
+				Level:     "error",
+				Message:   sarifMessage{Text: fmt.Sprintf("%v is infected with %v", f.Path, f.Signature)},
+				Locations: []sarifLocation{sarifPath(f.Path)},
+			})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{Schema: sarifSchema, Version: "2.1.0", Runs: []sarifRun{run}})
+}
+
+// sarifPath locates a file by a relative URI reference, or a file URI when the path is absolute
+func sarifPath(path string) sarifLocation {
+	var l sarifLocation
+	u := &url.URL{Path: filepath.ToSlash(path)}
+	if filepath.IsAbs(path) {
+		u.Scheme = "file"
+		if !strings.HasPrefix(u.Path, "/") {
+			// windows paths such as C:/dir
+			u.Path = "/" + u.Path
+		}
+	}
+	l.PhysicalLocation.ArtifactLocation.URI = u.String()
+	return l
+}
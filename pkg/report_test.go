@@ -0,0 +1,91 @@
+package chowder
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testResults = []FileResult{
+	{Path: "dist/app.js", Size: 10, Message: "stream: OK", Duration: 20 * time.Millisecond},
+	{Path: "dist/eicar.com", Size: 68, Infected: true, Signature: "Eicar-Test-Signature", Message: "stream: Eicar-Test-Signature FOUND", Duration: 5 * time.Millisecond},
+	{Path: "dist/locked.bin", Error: "permission denied"},
+}
+
+func TestReportSummarises(t *testing.T) {
+	sut := NewReport(testResults, time.Second)
+
+	assert.Equal(t, ReportSummary{Files: 3, Bytes: 78, Clean: 1, Infected: 1, Errors: 1, Duration: time.Second}, sut.Summary)
+}
+
+func TestReportWritesText(t *testing.T) {
+	var b bytes.Buffer
+
+	assert.Nil(t, NewReport(testResults, 1500*time.Millisecond).Write(&b, "text"))
+
+	assert.Equal(t, `dist/app.js: OK
+dist/eicar.com: Eicar-Test-Signature FOUND
+dist/locked.bin: permission denied ERROR
+
+----------- SCAN SUMMARY -----------
+Scanned files: 3
+Scanned bytes: 78
+Infected files: 1
+Errors: 1
+Time: 1.5s
+`, b.String())
+}
+
+func TestReportWritesJSON(t *testing.T) {
+	var b bytes.Buffer
+
+	assert.Nil(t, NewReport(testResults, time.Second).Write(&b, "json"))
+
+	got := &Report{}
+	assert.Nil(t, json.Unmarshal(b.Bytes(), got))
+	assert.Equal(t, "Eicar-Test-Signature", got.Results[1].Signature)
+	assert.Equal(t, 1, got.Summary.Infected)
+	assert.NotNil(t, NewReport(nil, 0).Write(&b, "xml"))
+}
+
+func TestReportWritesJUnit(t *testing.T) {
+	var b bytes.Buffer
+
+	assert.Nil(t, NewReport(testResults, time.Second).Write(&b, "junit"))
+
+	assert.Equal(t, xml.Header+`<testsuites>
+  <testsuite name="chowder" tests="3" failures="1" errors="1" time="1.000">
+    <testcase name="dist/app.js" classname="chowder.scan" time="0.020"></testcase>
+    <testcase name="dist/eicar.com" classname="chowder.scan" time="0.005">
+      <failure message="Eicar-Test-Signature FOUND" type="Eicar-Test-Signature">stream: Eicar-Test-Signature FOUND</failure>
+    </testcase>
+    <testcase name="dist/locked.bin" classname="chowder.scan" time="0.000">
+      <error message="permission denied"></error>
+    </testcase>
+  </testsuite>
+</testsuites>
+`, b.String())
+}
+
+func TestReportWritesSARIF(t *testing.T) {
+	results := append([]FileResult{{Path: "/srv/www/eicar.txt", Infected: true, Signature: "Eicar-Test-Signature"}}, testResults...)
+	var b bytes.Buffer
+
+	assert.Nil(t, NewReport(results, time.Second).Write(&b, "sarif"))
+
+	got := &sarifLog{}
+	assert.Nil(t, json.Unmarshal(b.Bytes(), got))
+	assert.Equal(t, "2.1.0", got.Version)
+	run := got.Runs[0]
+	assert.Equal(t, []sarifRule{{ID: "Eicar-Test-Signature", ShortDescription: sarifMessage{Text: "Malware matching the Eicar-Test-Signature signature"}}}, run.Tool.Driver.Rules)
+	assert.Len(t, run.Results, 2)
+	assert.Equal(t, "Eicar-Test-Signature", run.Results[1].RuleID)
+	assert.Equal(t, "file:///srv/www/eicar.txt", run.Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, "dist/eicar.com", run.Results[1].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.False(t, run.Invocations[0].ExecutionSuccessful)
+	assert.Equal(t, "permission denied", run.Invocations[0].Notifications[0].Message.Text)
+}
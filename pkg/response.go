@@ -1,6 +1,7 @@
 package chowder
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 )
@@ -23,3 +24,65 @@ func writeResponse(w http.ResponseWriter, r *http.Request, resp interface{}, cod
 	}
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
+
+// httpError is an error answered with its status
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// enableFullDuplex lets a handler keep reading the request body after it starts writing the response, which
+// net/http otherwise prevents over HTTP/1.x. It reports whether the handler can do so.
+func enableFullDuplex(w http.ResponseWriter, r *http.Request) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	for {
+		switch rw := w.(type) {
+		case interface{ EnableFullDuplex() error }:
+			return rw.EnableFullDuplex() == nil
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// responseRecorder captures a handler's response to a request from another protocol (e.g. ICAP)
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// serveRecorded serves r with handler, capturing the response
+func serveRecorded(handler http.Handler, r *http.Request) *responseRecorder {
+	rec := &responseRecorder{header: http.Header{}}
+	handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
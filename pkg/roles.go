@@ -0,0 +1,85 @@
+package chowder
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// RoleScanner may submit content for scanning
+	RoleScanner = "scanner"
+	// RoleReader may read operational data such as metrics
+	RoleReader = "reader"
+	// RoleAdmin may perform administrative operations and holds every other role
+	RoleAdmin = "admin"
+)
+
+var (
+	// DefaultRoles are granted to users configured without roles, matching what every token could do before roles
+	DefaultRoles = []string{RoleScanner, RoleReader}
+	knownRoles   = map[string]bool{RoleScanner: true, RoleReader: true, RoleAdmin: true}
+	accessDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_access_denied_total",
+		Help: "The total number of requests denied for lacking the role a route requires",
+	}, []string{"role"})
+)
+
+func validateRoles(roles []string) error {
+	for _, r := range roles {
+		if !knownRoles[r] {
+			return fmt.Errorf("unknown role '%v', must be one of %v, %v or %v", r, RoleScanner, RoleReader, RoleAdmin)
+		}
+	}
+	return nil
+}
+
+// HasRole reports whether the identity holds role. Credential scopes only grant roles once mapped into
+// Roles (see JWTOptions.RoleScopePrefix) so that an issuer's own `admin` scope means nothing to chowder.
+func (id *Identity) HasRole(role string) bool {
+	for _, r := range id.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeRoles returns the chowder roles named by scopes carrying prefix, ignoring every other scope
+func scopeRoles(scopes []string, prefix string) []string {
+	var roles []string
+	for _, s := range scopes {
+		if !strings.HasPrefix(s, prefix) {
+			continue
+		}
+		if r := strings.TrimPrefix(s, prefix); knownRoles[r] {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// RequireRole only allows callers holding role through to handle, answering 403 otherwise. It relies on
+// HeaderAuth having identified the caller, so requests are allowed when authentication is disabled.
+func RequireRole(role string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id := getIdentity(r.Context())
+		if id != nil && !id.HasRole(role) {
+			accessDenied.WithLabelValues(role).Inc()
+			addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+				return l.Str("denied-role", role)
+			})
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusForbidden),
+				Message: fmt.Sprintf("role '%v' required", role),
+			}, http.StatusForbidden)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
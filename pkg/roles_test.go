@@ -0,0 +1,43 @@
+package chowder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireRoleEnforcesRoles(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		id   *Identity
+		want int
+	}{
+		{"auth disabled", nil, http.StatusOK},
+		{"has role", &Identity{User: "u", Roles: []string{RoleScanner}}, http.StatusOK},
+		{"admin", &Identity{User: "u", Roles: []string{RoleAdmin}}, http.StatusOK},
+		{"unmapped scope", &Identity{User: "u", Scopes: []string{"openid", RoleScanner}}, http.StatusForbidden},
+		{"other role", &Identity{User: "u", Roles: []string{RoleReader}}, http.StatusForbidden},
+		{"no roles", &Identity{User: "u"}, http.StatusForbidden},
+	} {
+		called := false
+		sut := RequireRole(RoleScanner, func(http.ResponseWriter, *http.Request, httprouter.Params) {
+			called = true
+		})
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/scan", nil)
+		if c.id != nil {
+			r = r.WithContext(setIdentity(r.Context(), c.id))
+		}
+
+		sut(rw, r, nil)
+
+		assert.Equal(t, c.want, rw.Code, c.name)
+		assert.Equal(t, c.want == http.StatusOK, called, c.name)
+		if c.want == http.StatusForbidden {
+			assert.Equal(t, `{"message":"role 'scanner' required","error":"Forbidden"}`, rw.Body.String(), c.name)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package chowder
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// S3MaxTags is the most tags S3 allows on an object
+	S3MaxTags      = 10
+	s3Algorithm    = "AWS4-HMAC-SHA256"
+	s3TimeFormat   = "20060102T150405Z"
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Client is a minimal client for S3 compatible object storage (e.g. MinIO), addressing buckets by path and
+// signing requests with AWS Signature Version 4
+type S3Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+	now       func() time.Time
+}
+
+// NewS3Client returns a client for the S3 compatible endpoint, e.g. http://minio:9000
+func NewS3Client(endpoint, region, accessKey, secretKey string) (*S3Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint '%v' must be an http or https url", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Client{endpoint: u, region: region, accessKey: accessKey, secretKey: secretKey, http: &http.Client{}, now: time.Now}, nil
+}
+
+// S3Error is an error response from the object storage
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 returned %v %v", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3 returned %v %v: %v", e.StatusCode, e.Code, e.Message)
+}
+
+// GetObject returns the content of the object, which the caller must close
+func (c *S3Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, "", nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// s3Tagging is the document S3 reads and writes the tags of an object in
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// GetObjectTagging returns the tags of the object
+func (c *S3Client) GetObjectTagging(ctx context.Context, bucket, key string) (map[string]string, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, "tagging", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tagging s3Tagging
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&tagging); err != nil {
+		return nil, fmt.Errorf("could not decode tags: %v", err)
+	}
+	tags := make(map[string]string, len(tagging.Tags))
+	for _, t := range tagging.Tags {
+		tags[t.Key] = t.Value
+	}
+	return tags, nil
+}
+
+// PutObjectTagging replaces the tags of the object
+func (c *S3Client) PutObjectTagging(ctx context.Context, bucket, key string, tags map[string]string) error {
+	var tagging s3Tagging
+	for k, v := range tags {
+		tagging.Tags = append(tagging.Tags, s3Tag{Key: k, Value: v})
+	}
+	sort.Slice(tagging.Tags, func(i, j int) bool {
+		return tagging.Tags[i].Key < tagging.Tags[j].Key
+	})
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	return c.discard(c.do(ctx, http.MethodPut, bucket, key, "tagging", header, body))
+}
+
+// CopyObject copies the object server side, with its tags if tags is nil and with tags in their place otherwise
+func (c *S3Client) CopyObject(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, tags map[string]string) error {
+	header := http.Header{
+		"X-Amz-Copy-Source":       {s3EscapedPath(srcBucket, srcKey)},
+		"X-Amz-Tagging-Directive": {"COPY"},
+	}
+	if tags != nil {
+		values := url.Values{}
+		for k, v := range tags {
+			values.Set(k, v)
+		}
+		header.Set("X-Amz-Tagging-Directive", "REPLACE")
+		header.Set("X-Amz-Tagging", values.Encode())
+	}
+	resp, err := c.do(ctx, http.MethodPut, dstBucket, dstKey, "", header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// a copy can fail after the 200 has been sent, reporting the error in the body
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return fmt.Errorf("could not read copy response: %v", err)
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		e := &S3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(b, e)
+		return e
+	}
+	return nil
+}
+
+// DeleteObject deletes the object
+func (c *S3Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	return c.discard(c.do(ctx, http.MethodDelete, bucket, key, "", nil, nil))
+}
+
+func (c *S3Client) discard(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.Body.Close()
+}
+
+// do sends a signed request, returning an *S3Error for unsuccessful responses
+func (c *S3Client) do(ctx context.Context, method, bucket, key, query string, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = c.endpoint.Path + s3Path(bucket, key)
+	u.RawPath = c.endpoint.Path + s3EscapedPath(bucket, key)
+	u.RawQuery = query
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create s3 request: %v", err)
+	}
+	if body == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	c.sign(req, body)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach s3: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &S3Error{StatusCode: resp.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(b, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the host, the request's headers and its body
+func (c *S3Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	payload := s3EmptyPayload
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payload = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	day := now.Format("20060102")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := s3Algorithm + "\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s3Algorithm, c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Path is the unescaped path of an object
+func s3Path(bucket, key string) string {
+	if key == "" {
+		return "/" + bucket
+	}
+	return "/" + bucket + "/" + key
+}
+
+// s3EscapedPath escapes an object's path the way Signature Version 4 expects, leaving the slashes
+func s3EscapedPath(bucket, key string) string {
+	segments := strings.Split(s3Path(bucket, key), "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything but the unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,359 @@
+package chowder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// S3VerdictTag is the tag set to clean or infected on scanned objects
+	S3VerdictTag = "chowder-verdict"
+	// S3SignatureTag is the tag set to the signature found in infected objects
+	S3SignatureTag = "chowder-signature"
+	// S3ScannedTag is the tag set to the time objects were scanned
+	S3ScannedTag = "chowder-scanned"
+	// maxS3EventBody bounds the json body of a POST /scan/s3 or of a bucket notification
+	maxS3EventBody = 1 << 20
+)
+
+var s3Objects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chowder_s3_objects_total",
+	Help: "The total number of objects scanned in object storage by outcome",
+}, []string{"outcome"})
+
+// s3CreatedEvents are the bucket notifications for new content, leaving out those for new tags and the
+// like so that tagging an object does not have it scanned again
+var s3CreatedEvents = map[string]bool{
+	"ObjectCreated:Put":                     true,
+	"ObjectCreated:Post":                    true,
+	"ObjectCreated:Copy":                    true,
+	"ObjectCreated:CompleteMultipartUpload": true,
+}
+
+// S3Scanner scans objects in S3 compatible object storage, tagging them with the verdict and moving those
+// that are infected to the quarantine bucket if there is one
+type S3Scanner struct {
+	Client *S3Client
+	// Buckets whose objects may be scanned, any if empty
+	Buckets []string
+	// Quarantine is the bucket infected objects are moved to, none if empty. Its objects are never scanned.
+	Quarantine string
+}
+
+// NewS3Scanner returns an S3Scanner for the comma separated buckets
+func NewS3Scanner(client *S3Client, buckets, quarantine string) *S3Scanner {
+	return &S3Scanner{Client: client, Buckets: splitList(buckets), Quarantine: quarantine}
+}
+
+// S3ObjectRequest is the body of a POST /scan/s3
+type S3ObjectRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// S3ScanResponse is a response with the result of scanning an object
+type S3ScanResponse struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Infected    bool   `json:"infected"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	Response    `json:",omitempty"`
+}
+
+// S3EventsResponse is a response with the results of scanning the objects of a bucket notification
+type S3EventsResponse struct {
+	Objects  []S3ScanResponse `json:"objects"`
+	Response `json:",omitempty"`
+}
+
+// s3Event is the part of an S3 (or MinIO) bucket notification needed to find the objects created
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// s3Body stands in for the body of a POST /scan/s3, reading the object once it is fetched
+type s3Body struct {
+	object S3ObjectRequest
+	lateBody
+}
+
+// FetchS3 wraps POST /scan/s3, checking the bucket in the S3ObjectRequest body and standing in a body that
+// ScanS3 fills with the object once the scan is admitted. Applied outside the limits and quotas, they
+// meter the object as if it had been uploaded.
+func (p *Proxy) FetchS3(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if p.S3 == nil {
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusNotFound),
+				Message: "scanning object storage is not enabled",
+			}, http.StatusNotFound)
+			return
+		}
+		req := S3ObjectRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxS3EventBody)).Decode(&req); err != nil {
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusBadRequest),
+				Message: fmt.Sprintf("could not decode request: %v", err),
+			}, http.StatusBadRequest)
+			return
+		}
+		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+			return l.Str("bucket", req.Bucket).Str("key", req.Key)
+		})
+		if req.Bucket == "" || req.Key == "" {
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusBadRequest),
+				Message: "bucket and key are required",
+			}, http.StatusBadRequest)
+			return
+		}
+		if !p.S3.allowed(req.Bucket) {
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusForbidden),
+				Message: fmt.Sprintf("bucket '%v' is not allowed", req.Bucket),
+			}, http.StatusForbidden)
+			return
+		}
+		body := &s3Body{object: req}
+		r = r.WithContext(context.WithValue(r.Context(), s3BodyKey, body))
+		r.Body = body
+		r.ContentLength = -1
+		handle(w, r, ps)
+	}
+}
+
+// ScanS3 scans the object checked by FetchS3, tagging it with the verdict and quarantining it if infected
+func (p *Proxy) ScanS3(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Debug().Msg("received scan s3 request")
+	body, ok := r.Context().Value(s3BodyKey).(*s3Body)
+	if !ok || p.S3 == nil {
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusInternalServerError),
+			Message: "scan s3 route is not wrapped by FetchS3",
+		}, http.StatusInternalServerError)
+		return
+	}
+	obj := body.object
+	infected, msg, scanned := p.scan(w, r, func() (io.ReadCloser, error) {
+		content, err := p.S3.get(r.Context(), obj.Bucket, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		body.content = content
+		// read through whatever wraps the body, e.g. to meter it
+		return r.Body, nil
+	})
+	if !scanned {
+		s3Objects.WithLabelValues("error").Inc()
+		return
+	}
+	res := S3ScanResponse{Bucket: obj.Bucket, Key: obj.Key, Infected: infected, Response: Response{Message: msg}}
+	if err := p.S3.apply(r.Context(), &res); err != nil {
+		addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+			return l.Err(err)
+		})
+		res.Error = err.Error()
+		writeResponse(w, r, &res, http.StatusBadGateway)
+		return
+	}
+	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+		return l.Bool("quarantined", res.Quarantined)
+	})
+	writeResponse(w, r, &res, http.StatusOK)
+}
+
+// S3Events receives bucket notifications, scanning each object created in an allowed bucket and tagging or
+// quarantining it like ScanS3. Each object scanned counts as a scan against the caller's quotas, though not
+// against byte limits. Objects are scanned before answering, and the notification fails if any
+// could not be so that the object storage sends it again. Objects deleted before they could be scanned are
+// reported without failing it.
+func (p *Proxy) S3Events(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Debug().Msg("received s3 event")
+	if p.S3 == nil {
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusNotFound),
+			Message: "scanning object storage is not enabled",
+		}, http.StatusNotFound)
+		return
+	}
+	event := s3Event{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxS3EventBody)).Decode(&event); err != nil {
+		writeResponse(w, r, &Response{
+			Error:   http.StatusText(http.StatusBadRequest),
+			Message: fmt.Sprintf("could not decode event: %v", err),
+		}, http.StatusBadRequest)
+		return
+	}
+	resp := S3EventsResponse{Objects: []S3ScanResponse{}}
+	status, skipped := http.StatusOK, 0
+	for _, rec := range event.Records {
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		bucket := rec.S3.Bucket.Name
+		if err != nil || !s3CreatedEvents[strings.TrimPrefix(rec.EventName, "s3:")] || !p.S3.allowed(bucket) {
+			skipped++
+			continue
+		}
+		res := S3ScanResponse{Bucket: bucket, Key: key}
+		infected, msg, err := p.scanAdmitted(r, func() (io.ReadCloser, error) {
+			return p.S3.get(r.Context(), bucket, key)
+		})
+		if err == nil {
+			// each object scanned is charged to the caller's quota, even if it then cannot be tagged
+			reportScanned(r.Context())
+			res.Infected, res.Message = infected, msg
+			err = p.S3.apply(r.Context(), &res)
+		}
+		if err != nil {
+			res.Error = err.Error()
+			e, ok := err.(*httpError)
+			switch {
+			case ok && e.status == http.StatusNotFound:
+			case ok && status == http.StatusOK:
+				status = e.status
+			case status == http.StatusOK:
+				status = http.StatusBadGateway
+			}
+			if !ok || e.status != http.StatusNotFound {
+				s3Objects.WithLabelValues("error").Inc()
+			}
+		}
+		resp.Objects = append(resp.Objects, res)
+	}
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(p.Admission.RetryAfter().Seconds())))
+	}
+	if status != http.StatusOK {
+		resp.Error = http.StatusText(status)
+		resp.Message = "not every object could be scanned"
+	}
+	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+		return l.Int("s3-objects", len(resp.Objects)).Int("s3-skipped", skipped)
+	})
+	writeResponse(w, r, &resp, status)
+}
+
+// allowed reports whether objects in bucket may be scanned
+func (s *S3Scanner) allowed(bucket string) bool {
+	if bucket == "" || bucket == s.Quarantine {
+		return false
+	}
+	if len(s.Buckets) == 0 {
+		return true
+	}
+	for _, b := range s.Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the content of the object, with an *httpError if it cannot
+func (s *S3Scanner) get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	content, _, err := s.Client.GetObject(ctx, bucket, key)
+	if e, ok := err.(*S3Error); ok && e.StatusCode == http.StatusNotFound {
+		return nil, &httpError{status: http.StatusNotFound, msg: fmt.Sprintf("object %v/%v does not exist", bucket, key)}
+	}
+	if err != nil {
+		return nil, &httpError{status: http.StatusBadGateway, msg: fmt.Sprintf("could not get object: %v", err)}
+	}
+	return content, nil
+}
+
+// apply tags the object scanned with its verdict, keeping its other tags, or moves it to the quarantine
+// bucket with the verdict tags if it is infected. Quarantining does not depend on the object's tags, so an
+// object whose tags cannot be read or leave no room for the verdict is still moved, without the tags that
+// do not fit.
+func (s *S3Scanner) apply(ctx context.Context, res *S3ScanResponse) error {
+	verdict := map[string]string{
+		S3VerdictTag: "clean",
+		S3ScannedTag: time.Now().UTC().Format(time.RFC3339),
+	}
+	if res.Infected {
+		verdict[S3VerdictTag] = "infected"
+		verdict[S3SignatureTag] = s3TagValue(Signature(res.Message))
+	}
+	quarantine := res.Infected && s.Quarantine != ""
+	tags, err := s.Client.GetObjectTagging(ctx, res.Bucket, res.Key)
+	if err != nil && !quarantine {
+		return fmt.Errorf("could not get tags: %v", err)
+	}
+	if quarantine {
+		if err := s.Client.CopyObject(ctx, res.Bucket, res.Key, s.Quarantine, res.Key, withVerdict(tags, verdict, S3MaxTags)); err != nil {
+			return fmt.Errorf("could not copy object to quarantine: %v", err)
+		}
+		if err := s.Client.DeleteObject(ctx, res.Bucket, res.Key); err != nil {
+			return fmt.Errorf("could not delete quarantined object: %v", err)
+		}
+		res.Quarantined = true
+		s3Objects.WithLabelValues("quarantined").Inc()
+		return nil
+	}
+	if err := s.Client.PutObjectTagging(ctx, res.Bucket, res.Key, withVerdict(tags, verdict, 0)); err != nil {
+		return fmt.Errorf("could not tag object: %v", err)
+	}
+	if res.Infected {
+		s3Objects.WithLabelValues("infected").Inc()
+	} else {
+		s3Objects.WithLabelValues("clean").Inc()
+	}
+	return nil
+}
+
+// withVerdict returns tags with the verdict in place of any earlier one, keeping only as many of the other
+// tags (by key order) as fit in max if it is positive
+func withVerdict(tags, verdict map[string]string, max int) map[string]string {
+	merged := make(map[string]string, len(tags)+len(verdict))
+	var others []string
+	for k := range tags {
+		if k != S3VerdictTag && k != S3SignatureTag && k != S3ScannedTag {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	if max > 0 && len(others) > max-len(verdict) {
+		others = others[:max-len(verdict)]
+	}
+	for _, k := range others {
+		merged[k] = tags[k]
+	}
+	for k, v := range verdict {
+		merged[k] = v
+	}
+	return merged
+}
+
+// s3TagValue drops the characters S3 does not allow in tag values
+func s3TagValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return -1
+	}, v)
+}
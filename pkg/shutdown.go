@@ -0,0 +1,59 @@
+package chowder
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var drainDuration = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "chowder_drain_duration_seconds",
+	Help: "How long the most recent shutdown took to drain in seconds",
+})
+
+// Server is a listener that Shutdown can stop gracefully, e.g. *http.Server or *ICAPServer
+type Server interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// Shutdown gracefully stops the servers. Health checks fail first so that load balancers stop sending traffic,
+// then after delay the listeners close and in flight requests (and their scans) have up to timeout to
+// finish before any remaining connections are closed.
+func Shutdown(l zerolog.Logger, p *Proxy, delay, timeout time.Duration, servers ...Server) error {
+	start := time.Now()
+	defer func() {
+		drainDuration.Set(time.Since(start).Seconds())
+	}()
+	p.Drain()
+	l.Info().Dur("delay", delay).Int64("inflight", p.Inflight()).Msg("draining, failing health checks")
+	time.Sleep(delay)
+	l.Info().Dur("timeout", timeout).Int64("inflight", p.Inflight()).Msg("shutting down, waiting for in flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv Server) {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				srv.Close()
+			}
+			errs <- err
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		l.Error().Err(err).Int64("inflight", p.Inflight()).Msg("in flight requests did not finish, closing connections")
+		return err
+	}
+	l.Info().Dur("duration", time.Since(start)).Msg("drained")
+	return nil
+}
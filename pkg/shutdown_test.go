@@ -0,0 +1,73 @@
+package chowder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingServer starts a server whose requests block until finish is closed
+func blockingServer(body string) (ts *httptest.Server, started, finish chan struct{}) {
+	started, finish = make(chan struct{}), make(chan struct{})
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.Write([]byte(body))
+	}))
+	return
+}
+
+func TestShutdownDrainsBeforeClosing(t *testing.T) {
+	sut := &Proxy{}
+	ts, started, finish := blockingServer("scanned")
+	defer ts.Close()
+	closing := make(chan struct{})
+	ts.Config.RegisterOnShutdown(func() { close(closing) })
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		result <- string(b)
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Shutdown(zerolog.Nop(), sut, time.Millisecond, time.Minute, ts.Config)
+	}()
+	<-closing
+	// the listener only closes once the proxy is failing health checks
+	assert.True(t, sut.Draining())
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with a request in flight")
+	default:
+	}
+	close(finish)
+
+	assert.Nil(t, <-done)
+	assert.Equal(t, "scanned", <-result)
+}
+
+func TestShutdownClosesAfterTimeout(t *testing.T) {
+	ts, started, finish := blockingServer("")
+	defer ts.Close()
+	go http.Get(ts.URL)
+	<-started
+
+	err := Shutdown(zerolog.Nop(), &Proxy{}, 0, 10*time.Millisecond, ts.Config)
+	// release the handler before the deferred ts.Close waits on it
+	close(finish)
+
+	assert.NotNil(t, err)
+}
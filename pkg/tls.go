@@ -0,0 +1,238 @@
+package chowder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chowder_tls_certificate_expiry_timestamp_seconds",
+		Help: "The unix time the served TLS certificate expires",
+	})
+	certificateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_tls_certificate_reloads_total",
+		Help: "The total number of TLS key pair reloads by result",
+	}, []string{"result"})
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// TLSMode decides whether and how chowder serves TLS
+type TLSMode string
+
+const (
+	// TLSOff serves plaintext HTTP
+	TLSOff TLSMode = "off"
+	// TLSRequired serves HTTPS and refuses to start without both the certificate and key files
+	TLSRequired TLSMode = "required"
+	// TLSAuto serves HTTPS when both files exist and plaintext when neither does
+	TLSAuto TLSMode = "auto"
+	// TLSSelfSigned serves HTTPS with an ephemeral self signed certificate, for development only
+	TLSSelfSigned TLSMode = "selfsigned"
+)
+
+// ParseTLSMode parses off, required, auto or selfsigned
+func ParseTLSMode(mode string) (TLSMode, error) {
+	switch m := TLSMode(strings.ToLower(strings.TrimSpace(mode))); m {
+	case TLSOff, TLSRequired, TLSAuto, TLSSelfSigned:
+		return m, nil
+	}
+	return "", fmt.Errorf("tls mode '%v' must be one of off, required, auto or selfsigned", mode)
+}
+
+// UseFiles reports whether the mode serves the key pair in certFile and keyFile, failing if the
+// mode requires them and they are missing or only one of them exists
+func (m TLSMode) UseFiles(certFile, keyFile string) (bool, error) {
+	if m == TLSOff || m == TLSSelfSigned {
+		return false, nil
+	}
+	_, errCert := os.Stat(certFile)
+	_, errKey := os.Stat(keyFile)
+	switch {
+	case errCert == nil && errKey == nil:
+		return true, nil
+	case m == TLSAuto && os.IsNotExist(errCert) && os.IsNotExist(errKey):
+		return false, nil
+	case errCert != nil && errKey != nil:
+		return false, fmt.Errorf("tls %v but certfile and keyfile are unusable: %v, %v", m, errCert, errKey)
+	case errCert != nil:
+		return false, fmt.Errorf("tls %v but certfile is unusable: %v", m, errCert)
+	}
+	return false, fmt.Errorf("tls %v but keyfile is unusable: %v", m, errKey)
+}
+
+// SelfSignedCertificate generates an ephemeral certificate for hosts (names or IPs) valid for validity
+func SelfSignedCertificate(hosts []string, validity time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not generate serial number: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "chowder self signed"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not parse certificate: %v", err)
+	}
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// CertReloader serves a TLS key pair from disk, picking up a renewed pair (e.g. from cert-manager)
+// without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// NewCertReloader loads the key pair from certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload rereads the key pair if either file has changed since it was last read, reporting whether it did.
+// A pair that fails to load leaves the previous one in use.
+func (c *CertReloader) Reload() (bool, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			certificateReloads.WithLabelValues("error").Inc()
+			return false, fmt.Errorf("could not stat tls credentials: %v", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTimes == c.modTimes
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		certificateReloads.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("could not load tls credentials: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		certificateReloads.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("could not parse tls certificate: %v", err)
+	}
+	cert.Leaf = leaf
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTimes = modTimes
+	c.mu.Unlock()
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	certificateReloads.WithLabelValues("success").Inc()
+	return true, nil
+}
+
+// Watch polls the key pair for changes every interval until stop is closed, reporting each reload
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}, reloaded func(changed bool, err error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			changed, err := c.Reload()
+			if changed || err != nil {
+				reloaded(changed, err)
+			}
+		}
+	}
+}
+
+// GetCertificate returns the current key pair, for use as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Expiry returns when the current certificate expires
+func (c *CertReloader) Expiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert.Leaf.NotAfter
+}
+
+// ParseTLSVersion parses a minimum TLS version of 1.0, 1.1, 1.2 or 1.3
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("tls version '%v' must be one of 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses comma separated cipher suite names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256),
+// empty uses Go's defaults. Only TLS 1.0-1.2 suites are configurable, TLS 1.3 suites are always enabled.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%v'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
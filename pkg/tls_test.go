@@ -0,0 +1,127 @@
+package chowder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestKeyPair(t *testing.T, c testCert, certFile, keyFile string, modTime time.Time) {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600))
+	for _, f := range []string{certFile, keyFile} {
+		assert.Nil(t, os.Chtimes(f, modTime, modTime))
+	}
+}
+
+func TestCertReloaderPicksUpRenewedKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca := newTestCA(t)
+	first := newTestClientCert(t, ca, "first")
+	writeTestKeyPair(t, first, certFile, keyFile, time.Now())
+
+	sut, err := NewCertReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	changed, err := sut.Reload()
+	assert.False(t, changed)
+	assert.Nil(t, err)
+
+	second := newTestClientCert(t, ca, "second")
+	writeTestKeyPair(t, second, certFile, keyFile, time.Now().Add(time.Minute))
+	changed, err = sut.Reload()
+	assert.True(t, changed)
+	assert.Nil(t, err)
+	cert, err := sut.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, second.cert.NotAfter, sut.Expiry())
+
+	// a half written pair keeps the previous one in use
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("not a key"), 0600))
+	later := time.Now().Add(2 * time.Minute)
+	assert.Nil(t, os.Chtimes(keyFile, later, later))
+	_, err = sut.Reload()
+	assert.NotNil(t, err)
+	cert, _ = sut.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+}
+
+func TestParseTLSPolicy(t *testing.T) {
+	v, err := ParseTLSVersion("1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+	_, err = ParseTLSVersion("1.4")
+	assert.NotNil(t, err)
+
+	ids, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, ids)
+	ids, err = ParseCipherSuites("")
+	assert.Nil(t, err)
+	assert.Nil(t, ids)
+	_, err = ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+	assert.NotNil(t, err)
+}
+
+func TestTLSModeUseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	missing := filepath.Join(dir, "missing")
+	assert.Nil(t, ioutil.WriteFile(certFile, nil, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, nil, 0600))
+
+	for _, c := range []struct {
+		mode          TLSMode
+		cert, key     string
+		want, wantErr bool
+	}{
+		{TLSAuto, certFile, keyFile, true, false},
+		{TLSAuto, missing, missing, false, false},
+		{TLSAuto, certFile, missing, false, true},
+		{TLSAuto, missing, keyFile, false, true},
+		{TLSRequired, certFile, keyFile, true, false},
+		{TLSRequired, missing, missing, false, true},
+		{TLSRequired, certFile, missing, false, true},
+		{TLSOff, certFile, keyFile, false, false},
+		{TLSSelfSigned, certFile, keyFile, false, false},
+	} {
+		got, err := c.mode.UseFiles(c.cert, c.key)
+		assert.Equal(t, c.want, got, "%v %v %v", c.mode, c.cert, c.key)
+		assert.Equal(t, c.wantErr, err != nil, "%v %v %v", c.mode, c.cert, c.key)
+	}
+
+	mode, err := ParseTLSMode(" Required ")
+	assert.Nil(t, err)
+	assert.Equal(t, TLSRequired, mode)
+	_, err = ParseTLSMode("on")
+	assert.NotNil(t, err)
+}
+
+func TestSelfSignedCertificateServesLocalhost(t *testing.T) {
+	cert, err := SelfSignedCertificate([]string{"localhost", "127.0.0.1"}, time.Hour)
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		assert.Nil(t, err, host)
+	}
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	assert.NotNil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), cert.Leaf.NotAfter, time.Minute)
+}
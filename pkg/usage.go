@@ -0,0 +1,320 @@
+package chowder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var quotaExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "chowder_quota_exceeded_total",
+	Help: "The total number of scans refused for exceeding a user's quota",
+}, []string{"user", "period"})
+
+// Quota limits how much a user may scan per UTC day and month. In a users file a zero field
+// inherits the global default and a negative field removes that quota for the user.
+type Quota struct {
+	DailyBytes   int64 `yaml:"dailybytes,omitempty"`
+	DailyScans   int64 `yaml:"dailyscans,omitempty"`
+	MonthlyBytes int64 `yaml:"monthlybytes,omitempty"`
+	MonthlyScans int64 `yaml:"monthlyscans,omitempty"`
+}
+
+func (q *Quota) withDefaults(defaults Quota) Quota {
+	if q == nil {
+		return defaults
+	}
+	merged := *q
+	for _, f := range []struct{ v, d *int64 }{
+		{&merged.DailyBytes, &defaults.DailyBytes},
+		{&merged.DailyScans, &defaults.DailyScans},
+		{&merged.MonthlyBytes, &defaults.MonthlyBytes},
+		{&merged.MonthlyScans, &defaults.MonthlyScans},
+	} {
+		if *f.v == 0 {
+			*f.v = *f.d
+		}
+	}
+	return merged
+}
+
+// Usage counts scans and the bytes scanned
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Scans int64 `json:"scans"`
+}
+
+// UserUsage is a user's consumption for the current day and month along with their all time total
+type UserUsage struct {
+	Day     string `json:"day"`
+	Daily   Usage  `json:"daily"`
+	Month   string `json:"month"`
+	Monthly Usage  `json:"monthly"`
+	Total   Usage  `json:"total"`
+}
+
+// roll resets the daily and monthly counters when the period has moved on
+func (u *UserUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.Daily = day, Usage{}
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.Monthly = month, Usage{}
+	}
+}
+
+// UsageStore accounts for the scans each user makes, persisting the counters to a json file
+type UsageStore struct {
+	path     string
+	defaults Quota
+	mu       sync.Mutex
+	users    map[string]*UserUsage
+	dirty    bool
+	now      func() time.Time
+}
+
+// OpenUsageStore loads the counters persisted at path, an empty path keeps them in memory only
+func OpenUsageStore(path string, defaults Quota) (*UsageStore, error) {
+	s := &UsageStore{
+		path:     path,
+		defaults: defaults,
+		users:    make(map[string]*UserUsage),
+		now:      time.Now,
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage file: %v", err)
+	}
+	if err = json.Unmarshal(b, &s.users); err != nil {
+		return nil, fmt.Errorf("could not parse usage file: %v", err)
+	}
+	return s, nil
+}
+
+// Flush writes the counters to the usage file if they have changed, replacing it atomically
+func (s *UsageStore) Flush() error {
+	s.mu.Lock()
+	if s.path == "" || !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.users)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not encode usage: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write usage file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return fmt.Errorf("could not write usage file: %v", err)
+	}
+	return nil
+}
+
+// Run flushes the counters every interval until stop is closed, flushing a final time before returning
+func (s *UsageStore) Run(interval time.Duration, stop <-chan struct{}, failed func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			if err := s.Flush(); err != nil {
+				failed(err)
+			}
+			return
+		case <-t.C:
+			if err := s.Flush(); err != nil {
+				failed(err)
+			}
+		}
+	}
+}
+
+// Get returns a copy of a user's current usage
+func (s *UsageStore) Get(user string) UserUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.user(user)
+}
+
+// All returns a copy of every user's current usage
+func (s *UsageStore) All() map[string]UserUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[string]UserUsage, len(s.users))
+	for name := range s.users {
+		all[name] = *s.user(name)
+	}
+	return all
+}
+
+// user returns the rolled forward counters for user, the caller must hold the lock
+func (s *UsageStore) user(user string) *UserUsage {
+	u, ok := s.users[user]
+	if !ok {
+		u = &UserUsage{}
+		s.users[user] = u
+	}
+	u.roll(s.now().UTC())
+	return u
+}
+
+// reservation is a scan counted against a user's quota before it starts
+type reservation struct {
+	user, day, month string
+}
+
+// reserve counts a scan for user if their quota has room, otherwise returning the period whose quota is used
+// up and how long until it resets. Counting before the scan starts stops concurrent scans overshooting a quota.
+func (s *UsageStore) reserve(user string, q Quota) (*reservation, string, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(user)
+	now := s.now().UTC()
+	switch {
+	case over(u.Monthly.Scans, q.MonthlyScans), over(u.Monthly.Bytes, q.MonthlyBytes):
+		next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return nil, "monthly", next.Sub(now)
+	case over(u.Daily.Scans, q.DailyScans), over(u.Daily.Bytes, q.DailyBytes):
+		next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return nil, "daily", next.Sub(now)
+	}
+	for _, usage := range []*Usage{&u.Daily, &u.Monthly, &u.Total} {
+		usage.Scans++
+	}
+	s.dirty = true
+	return &reservation{user: user, day: u.Day, month: u.Month}, "", 0
+}
+
+// settle completes a reservation for a request that made scans that reached the antivirus, adding their
+// bytes and any scans beyond the one reserved, or returning the reserved scan to any period it was counted
+// in if the request made none
+func (s *UsageStore) settle(res *reservation, scans, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(res.user)
+	periods := []*Usage{&u.Total}
+	if u.Day == res.day {
+		periods = append(periods, &u.Daily)
+	}
+	if u.Month == res.month {
+		periods = append(periods, &u.Monthly)
+	}
+	for _, usage := range periods {
+		if scans > 0 {
+			usage.Scans += scans - 1
+			usage.Bytes += bytes
+		} else if usage.Scans > 0 {
+			usage.Scans--
+		}
+	}
+	s.dirty = true
+}
+
+func over(used, quota int64) bool {
+	return quota > 0 && used >= quota
+}
+
+// Enforce wraps a scan route, accounting each scan and its bytes to the caller and answering 429 with a
+// Retry-After once a quota is used up. The scan that crosses a byte quota is allowed to complete, as is the
+// request (e.g. a batch) that crosses a scan quota. Requests are charged for each scan the scanner reports,
+// and not at all if refused or failed on the way.
+func (s *UsageStore) Enforce(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, quota := "", s.defaults
+		if id := getIdentity(r.Context()); id != nil {
+			user, quota = id.User, id.Quota.withDefaults(s.defaults)
+		}
+		res, period, retry := s.reserve(user, quota)
+		if res == nil {
+			quotaExceeded.WithLabelValues(user, period).Inc()
+			addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+				return l.Str("quota-exceeded", period)
+			})
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			writeResponse(w, r, &Response{
+				Error:   http.StatusText(http.StatusTooManyRequests),
+				Message: fmt.Sprintf("%v quota exceeded", period),
+			}, http.StatusTooManyRequests)
+			return
+		}
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		report := &scanReport{}
+		handle(w, r.WithContext(context.WithValue(r.Context(), scanReportKey, report)), ps)
+		s.settle(res, atomic.LoadInt64(&report.scans), body.n)
+	}
+}
+
+// ServeUsage answers GET /usage with the caller's own usage, or everyone's for an admin
+func (s *UsageStore) ServeUsage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := getIdentity(r.Context())
+	if id == nil || id.HasRole(RoleAdmin) {
+		writeResponse(w, r, s.All(), http.StatusOK)
+		return
+	}
+	writeResponse(w, r, map[string]UserUsage{id.User: s.Get(id.User)}, http.StatusOK)
+}
+
+// scanReport lets the scanner tell Enforce how many scans a request actually made
+type scanReport struct {
+	scans int64
+}
+
+// reportScanned counts a scan made by the request carrying ctx so that it is charged to the caller's quota.
+// It is safe to call from the goroutines scanning a batch.
+func reportScanned(ctx context.Context) {
+	if report, ok := ctx.Value(scanReportKey).(*scanReport); ok {
+		atomic.AddInt64(&report.scans, 1)
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
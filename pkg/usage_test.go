@@ -0,0 +1,133 @@
+package chowder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupUsageTest(t *testing.T, defaults Quota) (*UsageStore, *time.Time, string) {
+	dir, err := ioutil.TempDir("", "chowder-usage")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "usage.json")
+	s, err := OpenUsageStore(path, defaults)
+	assert.Nil(t, err)
+	now := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, &now, path
+}
+
+// scanBody reads the request body and reports it scanned, as the proxy does
+func scanBody(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	readBody(w, r, ps)
+	reportScanned(r.Context())
+}
+
+func TestUsageStoreEnforcesDailyQuota(t *testing.T) {
+	sut, now, _ := setupUsageTest(t, Quota{DailyScans: 2})
+	scan := sut.Enforce(scanBody)
+	alice := &Identity{User: "alice"}
+
+	assert.Equal(t, http.StatusOK, limitedRequest(scan, alice, "abc").Code)
+	assert.Equal(t, http.StatusOK, limitedRequest(scan, alice, "de").Code)
+	rw := limitedRequest(scan, alice, "f")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "3601", rw.Header().Get("Retry-After"))
+	assert.Equal(t, `{"message":"daily quota exceeded","error":"Too Many Requests"}`, rw.Body.String())
+	// users may have their own quota
+	assert.Equal(t, http.StatusOK, limitedRequest(scan, &Identity{User: "bob", Quota: &Quota{DailyScans: -1}}, "").Code)
+
+	*now = now.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, limitedRequest(scan, alice, "g").Code)
+	assert.Equal(t, UserUsage{
+		Day:     "2026-10-19",
+		Daily:   Usage{Bytes: 1, Scans: 1},
+		Month:   "2026-10",
+		Monthly: Usage{Bytes: 6, Scans: 3},
+		Total:   Usage{Bytes: 6, Scans: 3},
+	}, sut.Get("alice"))
+}
+
+func TestUsageStoreEnforcesMonthlyBytes(t *testing.T) {
+	sut, _, _ := setupUsageTest(t, Quota{MonthlyBytes: 5})
+	scan := sut.Enforce(scanBody)
+	alice := &Identity{User: "alice"}
+
+	assert.Equal(t, http.StatusOK, limitedRequest(scan, alice, "123456").Code)
+	rw := limitedRequest(scan, alice, "1")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, `{"message":"monthly quota exceeded","error":"Too Many Requests"}`, rw.Body.String())
+}
+
+func TestUsageStoreOnlyChargesScannedRequests(t *testing.T) {
+	sut, _, _ := setupUsageTest(t, Quota{DailyScans: 1})
+	throttled := sut.Enforce(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	alice := &Identity{User: "alice"}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, limitedRequest(throttled, alice, "abc").Code)
+	}
+	assert.Equal(t, UserUsage{Day: "2026-10-18", Month: "2026-10"}, sut.Get("alice"))
+	assert.Equal(t, http.StatusOK, limitedRequest(sut.Enforce(scanBody), alice, "abc").Code)
+}
+
+func TestUsageStoreReservesScansBeforeScanning(t *testing.T) {
+	sut, _, _ := setupUsageTest(t, Quota{DailyScans: 1})
+	alice := &Identity{User: "alice"}
+	var inner *httptest.ResponseRecorder
+	scan := sut.Enforce(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		// a concurrent scan arriving while this one is in progress finds the quota used
+		inner = limitedRequest(sut.Enforce(scanBody), alice, "")
+		scanBody(w, r, ps)
+	})
+
+	assert.Equal(t, http.StatusOK, limitedRequest(scan, alice, "abc").Code)
+	assert.Equal(t, http.StatusTooManyRequests, inner.Code)
+	assert.Equal(t, Usage{Bytes: 3, Scans: 1}, sut.Get("alice").Daily)
+}
+
+func TestUsageStorePersistsCounters(t *testing.T) {
+	sut, _, path := setupUsageTest(t, Quota{})
+	limitedRequest(sut.Enforce(scanBody), &Identity{User: "alice"}, "abc")
+
+	assert.Nil(t, sut.Flush())
+	reopened, err := OpenUsageStore(path, Quota{})
+	assert.Nil(t, err)
+	reopened.now = sut.now
+
+	assert.Equal(t, sut.Get("alice"), reopened.Get("alice"))
+	assert.Equal(t, int64(3), reopened.Get("alice").Total.Bytes)
+}
+
+func TestServeUsageShowsOwnUsageOrEveryonesForAdmin(t *testing.T) {
+	sut, _, _ := setupUsageTest(t, Quota{})
+	scan := sut.Enforce(scanBody)
+	limitedRequest(scan, &Identity{User: "alice"}, "abc")
+	limitedRequest(scan, &Identity{User: "bob"}, "de")
+	get := func(id *Identity) string {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/usage", nil)
+		r = r.WithContext(setIdentity(r.Context(), id))
+		sut.ServeUsage(rw, r, nil)
+		return rw.Body.String()
+	}
+
+	own := get(&Identity{User: "alice", Roles: DefaultRoles})
+	assert.True(t, strings.HasPrefix(own, `{"alice":{"day":"2026-10-18","daily":{"bytes":3,"scans":1}`), own)
+	assert.NotContains(t, own, "bob")
+	all := get(&Identity{User: "root", Roles: []string{RoleAdmin}})
+	assert.Contains(t, all, `"alice"`)
+	assert.Contains(t, all, `"bob"`)
+}
@@ -0,0 +1,401 @@
+package chowder
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// HashSHA256 stores tokens as `sha256:<hex digest>`
+	HashSHA256 = "sha256"
+	// HashBcrypt stores tokens as a bcrypt `$2a$` hash
+	HashBcrypt = "bcrypt"
+	// HashArgon2id stores tokens as a PHC formatted `$argon2id$` hash
+	HashArgon2id = "argon2id"
+	// HashPlain stores tokens as plaintext, as chowder always has
+	HashPlain = "plain"
+)
+
+var (
+	usersReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chowder_users_reloads_total",
+		Help: "The total number of users file reloads by result",
+	}, []string{"result"})
+	slowVerifyBusy = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chowder_users_slow_verify_busy_total",
+		Help: "The total number of tokens refused because every bcrypt/argon2 verification slot stayed busy",
+	})
+	errEmptyReload                    = errors.New("refusing to reload an empty users file over a non-empty one")
+	_              TokenAuthenticator = &Users{}
+)
+
+// slowVerifyWait is how long a token waits for a slow verification slot before it is refused
+const slowVerifyWait = time.Second
+
+// Users is a reloadable set of authentication tokens (plaintext or hashed) mapped to usernames
+type Users struct {
+	mu      sync.RWMutex
+	path    string
+	loaded  bool
+	modTime time.Time
+	tokens  *tokenSet
+	// slowSlots bounds the concurrent bcrypt/argon2 verifications, each of which may take tens of
+	// milliseconds and (for argon2id) tens of megabytes, so a flood of unknown tokens cannot exhaust the host
+	slowSlots chan struct{}
+}
+
+// tokenSet is an immutable snapshot of the users file, swapped whole on reload
+type tokenSet struct {
+	fast []tokenEntry
+	slow []tokenEntry
+	// verified caches the SHA-256 of tokens that passed a slow (bcrypt/argon2) check
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]*UserEntry
+}
+
+// UserEntry is a users file entry, written either as a bare username (the original format) or as
+// `{user: name, roles: [...], priority: low, limits: {...}, quota: {...}}`. Entries without roles are granted DefaultRoles.
+type UserEntry struct {
+	User     string   `yaml:"user"`
+	Roles    []string `yaml:"roles,omitempty"`
+	Priority Priority `yaml:"priority,omitempty"`
+	Limits   *Limits  `yaml:"limits,omitempty"`
+	Quota    *Quota   `yaml:"quota,omitempty"`
+}
+
+// UnmarshalYAML accepts both a bare username and the full entry
+func (e *UserEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*e = UserEntry{User: name}
+		return nil
+	}
+	type plain UserEntry
+	if err := unmarshal((*plain)(e)); err != nil {
+		return err
+	}
+	if e.User == "" {
+		return errors.New("users file entry has no user")
+	}
+	return validateRoles(e.Roles)
+}
+
+func (e *UserEntry) identity(method string) *Identity {
+	roles := e.Roles
+	if len(roles) == 0 {
+		roles = DefaultRoles
+	}
+	return &Identity{User: e.User, Method: method, Roles: roles, Limits: e.Limits, Quota: e.Quota, Priority: e.Priority}
+}
+
+type tokenEntry struct {
+	entry  *UserEntry
+	verify func(token string, digest [sha256.Size]byte) bool
+}
+
+// NewUsers returns Users for a static map of tokens (or token hashes) to user entries
+func NewUsers(users map[string]UserEntry) (*Users, error) {
+	u := &Users{tokens: &tokenSet{}, slowSlots: newSlowSlots()}
+	if err := u.set(users); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// LoadUsers reads the users file at path, a missing file results in no users
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{path: path, tokens: &tokenSet{}, slowSlots: newSlowSlots()}
+	if _, err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Len returns the number of tokens configured
+func (u *Users) Len() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.tokens.fast) + len(u.tokens.slow)
+}
+
+// Enabled reports whether any tokens are configured
+func (u *Users) Enabled() bool {
+	return u.Len() > 0
+}
+
+// AuthenticateToken returns the Identity a token belongs to
+func (u *Users) AuthenticateToken(token string) (*Identity, bool) {
+	e, ok := u.lookup(token)
+	if !ok {
+		return nil, false
+	}
+	return e.identity("token"), true
+}
+
+// Authenticate returns the username a token belongs to. Plaintext and SHA-256 tokens are all compared
+// in constant time before the (deliberately slow) bcrypt and argon2 hashes are tried.
+func (u *Users) Authenticate(token string) (string, bool) {
+	e, ok := u.lookup(token)
+	if !ok {
+		return "", false
+	}
+	return e.User, true
+}
+
+func (u *Users) lookup(token string) (*UserEntry, bool) {
+	if token == "" {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(token))
+	u.mu.RLock()
+	tokens := u.tokens
+	u.mu.RUnlock()
+	var found *UserEntry
+	for _, e := range tokens.fast {
+		if e.verify(token, digest) && found == nil {
+			found = e.entry
+		}
+	}
+	if found != nil {
+		return found, true
+	}
+	tokens.mu.Lock()
+	found = tokens.verified[digest]
+	tokens.mu.Unlock()
+	if found != nil || len(tokens.slow) == 0 {
+		return found, found != nil
+	}
+	t := time.NewTimer(slowVerifyWait)
+	defer t.Stop()
+	select {
+	case u.slowSlots <- struct{}{}:
+		defer func() { <-u.slowSlots }()
+	case <-t.C:
+		slowVerifyBusy.Inc()
+		return nil, false
+	}
+	for _, e := range tokens.slow {
+		if e.verify(token, digest) {
+			tokens.mu.Lock()
+			tokens.verified[digest] = e.entry
+			tokens.mu.Unlock()
+			return e.entry, true
+		}
+	}
+	return nil, false
+}
+
+func newSlowSlots() chan struct{} {
+	return make(chan struct{}, runtime.NumCPU())
+}
+
+// Reload rereads the users file if it has changed since it was last read, reporting whether it did.
+// Requests already authenticated are unaffected and a failed reload keeps the previous users.
+func (u *Users) Reload() (bool, error) {
+	if u.path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(u.path)
+	if err != nil && !os.IsNotExist(err) {
+		usersReloads.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("could not stat users file: %v", err)
+	}
+	var modTime time.Time
+	if info != nil {
+		modTime = info.ModTime()
+	}
+	u.mu.RLock()
+	unchanged := u.loaded && modTime.Equal(u.modTime)
+	u.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	f, err := ioutil.ReadFile(u.path)
+	if err != nil && !os.IsNotExist(err) {
+		usersReloads.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("could not load users file: %v", err)
+	}
+	users := make(map[string]UserEntry)
+	if err = yaml.Unmarshal(f, users); err != nil {
+		usersReloads.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("failed reading user list: %v", err)
+	}
+	if len(users) == 0 && u.Len() > 0 {
+		usersReloads.WithLabelValues("error").Inc()
+		return false, errEmptyReload
+	}
+	if err = u.set(users); err != nil {
+		usersReloads.WithLabelValues("error").Inc()
+		return false, err
+	}
+	u.mu.Lock()
+	u.loaded = true
+	u.modTime = modTime
+	u.mu.Unlock()
+	usersReloads.WithLabelValues("success").Inc()
+	return true, nil
+}
+
+// Watch polls the users file for changes every interval until stop is closed, reporting each reload
+func (u *Users) Watch(interval time.Duration, stop <-chan struct{}, reloaded func(changed bool, err error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			changed, err := u.Reload()
+			if changed || err != nil {
+				reloaded(changed, err)
+			}
+		}
+	}
+}
+
+func (u *Users) set(users map[string]UserEntry) error {
+	var fast, slow []tokenEntry
+	for token, entry := range users {
+		entry := entry
+		e, isSlow, err := newTokenEntry(token, &entry)
+		if err != nil {
+			return fmt.Errorf("invalid token for user '%v': %v", entry.User, err)
+		}
+		if isSlow {
+			slow = append(slow, e)
+		} else {
+			fast = append(fast, e)
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.tokens = &tokenSet{fast: fast, slow: slow, verified: make(map[[sha256.Size]byte]*UserEntry)}
+	return nil
+}
+
+func newTokenEntry(token string, entry *UserEntry) (tokenEntry, bool, error) {
+	switch {
+	case strings.HasPrefix(token, HashSHA256+":"):
+		want, err := hex.DecodeString(strings.TrimPrefix(token, HashSHA256+":"))
+		if err != nil || len(want) != sha256.Size {
+			return tokenEntry{}, false, errors.New("sha256 hash must be 64 hex characters")
+		}
+		return tokenEntry{entry: entry, verify: func(_ string, digest [sha256.Size]byte) bool {
+			return subtle.ConstantTimeCompare(digest[:], want) == 1
+		}}, false, nil
+	case strings.HasPrefix(token, "$2a$"), strings.HasPrefix(token, "$2b$"), strings.HasPrefix(token, "$2y$"):
+		hash := []byte(token)
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return tokenEntry{}, false, err
+		}
+		return tokenEntry{entry: entry, verify: func(t string, _ [sha256.Size]byte) bool {
+			return bcrypt.CompareHashAndPassword(hash, []byte(t)) == nil
+		}}, true, nil
+	case strings.HasPrefix(token, "$"+HashArgon2id+"$"):
+		p, err := parseArgon2id(token)
+		if err != nil {
+			return tokenEntry{}, false, err
+		}
+		return tokenEntry{entry: entry, verify: func(t string, _ [sha256.Size]byte) bool {
+			key := argon2.IDKey([]byte(t), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+			return subtle.ConstantTimeCompare(key, p.key) == 1
+		}}, true, nil
+	default:
+		want := sha256.Sum256([]byte(token))
+		return tokenEntry{entry: entry, verify: func(_ string, digest [sha256.Size]byte) bool {
+			return subtle.ConstantTimeCompare(digest[:], want[:]) == 1
+		}}, false, nil
+	}
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2id parses the PHC string format `$argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>`
+func parseArgon2id(encoded string) (*argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("argon2id hash must have 6 '$' separated parts")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version '%v'", parts[2])
+	}
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters '%v': %v", parts[3], err)
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id key: %v", err)
+	}
+	// argon2 panics on zero time or threads, and an empty key would match every token
+	if p.time == 0 || p.threads == 0 || p.memory < 8*uint32(p.threads) {
+		return nil, fmt.Errorf("invalid argon2id parameters '%v': t and p must be positive and m at least 8*p", parts[3])
+	}
+	if len(p.salt) == 0 {
+		return nil, errors.New("argon2id salt must not be empty")
+	}
+	if len(p.key) < 16 {
+		return nil, errors.New("argon2id key must be at least 16 bytes")
+	}
+	return p, nil
+}
+
+// GenerateToken returns a new random token suitable for a users file
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken hashes token with the named algorithm into the form accepted as a users file key
+func HashToken(token, algorithm string) (string, error) {
+	switch algorithm {
+	case HashSHA256:
+		sum := sha256.Sum256([]byte(token))
+		return HashSHA256 + ":" + hex.EncodeToString(sum[:]), nil
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashArgon2id:
+		p := &argon2Params{memory: 64 * 1024, time: 1, threads: 4, salt: make([]byte, 16)}
+		if _, err := rand.Read(p.salt); err != nil {
+			return "", err
+		}
+		p.key = argon2.IDKey([]byte(token), p.salt, p.time, p.memory, p.threads, 32)
+		return fmt.Sprintf("$%v$v=%d$m=%d,t=%d,p=%d$%v$%v", HashArgon2id, argon2.Version, p.memory, p.time, p.threads,
+			base64.RawStdEncoding.EncodeToString(p.salt), base64.RawStdEncoding.EncodeToString(p.key)), nil
+	case HashPlain:
+		return token, nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm '%v', must be one of %v, %v, %v or %v", algorithm, HashSHA256, HashBcrypt, HashArgon2id, HashPlain)
+	}
+}
@@ -0,0 +1,189 @@
+package chowder
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUsersAuthenticatesHashedTokens(t *testing.T) {
+	sha, err := HashToken("sha-token", HashSHA256)
+	assert.Nil(t, err)
+	argon, err := HashToken("argon-token", HashArgon2id)
+	assert.Nil(t, err)
+	bc, err := bcrypt.GenerateFromPassword([]byte("bcrypt-token"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	sut, err := NewUsers(map[string]UserEntry{
+		"plain-token": {User: "plain"},
+		sha:           {User: "sha"},
+		argon:         {User: "argon"},
+		string(bc):    {User: "bcrypt"},
+	})
+	assert.Nil(t, err)
+
+	for token, want := range map[string]string{
+		"plain-token":  "plain",
+		"sha-token":    "sha",
+		"argon-token":  "argon",
+		"bcrypt-token": "bcrypt",
+	} {
+		user, ok := sut.Authenticate(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, want, user)
+		// a second check is served from the verified cache for slow hashes
+		user, ok = sut.Authenticate(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, want, user)
+	}
+	for _, token := range []string{"", "nope", sha, argon, string(bc)} {
+		_, ok := sut.Authenticate(token)
+		assert.False(t, ok, token)
+	}
+}
+
+func TestUsersBoundsConcurrentSlowVerifications(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("bcrypt-token"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	sut, err := NewUsers(map[string]UserEntry{string(bc): {User: "bcrypt"}})
+	assert.Nil(t, err)
+	sut.slowSlots = make(chan struct{}, 1)
+	var mu sync.Mutex
+	active, most := 0, 0
+	sut.tokens.slow[0].verify = func(string, [sha256.Size]byte) bool {
+		mu.Lock()
+		active++
+		if active > most {
+			most = active
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return false
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, ok := sut.Authenticate(fmt.Sprintf("bogus-%v", i))
+			assert.False(t, ok)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, most)
+}
+
+func TestUsersRejectsMalformedHashes(t *testing.T) {
+	_, err := NewUsers(map[string]UserEntry{"sha256:abc": {User: "user"}})
+	assert.NotNil(t, err)
+	_, err = NewUsers(map[string]UserEntry{"$argon2id$v=19$garbage": {User: "user"}})
+	assert.NotNil(t, err)
+	_, err = HashToken("token", "md5")
+	assert.NotNil(t, err)
+}
+
+func TestUsersRejectsWeakArgon2idHashes(t *testing.T) {
+	const salt, key = "c2FsdHNhbHRzYWx0c2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	for _, hash := range []string{
+		// an empty key would authenticate every token
+		"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$",
+		"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=4$$" + key,
+		"$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key,
+		"$argon2id$v=19$m=65536,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=16,t=1,p=4$" + salt + "$" + key,
+	} {
+		_, err := NewUsers(map[string]UserEntry{hash: {User: "user"}})
+		assert.NotNil(t, err, hash)
+	}
+	_, err := NewUsers(map[string]UserEntry{"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + key: {User: "user"}})
+	assert.Nil(t, err)
+}
+
+func TestUsersReloadsChangedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("old: olduser\n"), 0600))
+
+	sut, err := LoadUsers(path)
+	assert.Nil(t, err)
+	changed, err := sut.Reload()
+	assert.False(t, changed)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("new: newuser\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	changed, err = sut.Reload()
+	assert.True(t, changed)
+	assert.Nil(t, err)
+
+	_, ok := sut.Authenticate("old")
+	assert.False(t, ok)
+	user, ok := sut.Authenticate("new")
+	assert.True(t, ok)
+	assert.Equal(t, "newuser", user)
+}
+
+func TestUsersKeepsPreviousUsersOnBadReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("token: user\n"), 0600))
+	sut, err := LoadUsers(path)
+	assert.Nil(t, err)
+
+	for i, content := range []string{"", "sha256:nothex: user\n", "[not a map"} {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+		later := time.Now().Add(time.Duration(i+1) * time.Minute)
+		assert.Nil(t, os.Chtimes(path, later, later))
+		_, err = sut.Reload()
+		assert.NotNil(t, err, content)
+
+		user, ok := sut.Authenticate("token")
+		assert.True(t, ok)
+		assert.Equal(t, "user", user)
+	}
+}
+
+func TestUsersFileSupportsRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chowder-users")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yml")
+	content := "legacy: olduser\nadmin-token:\n  user: root\n  roles: [admin]\nreader-token: {user: grafana, roles: [reader], priority: low}\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	sut, err := LoadUsers(path)
+	assert.Nil(t, err)
+
+	for token, want := range map[string]*Identity{
+		"legacy":       {User: "olduser", Method: "token", Roles: DefaultRoles},
+		"admin-token":  {User: "root", Method: "token", Roles: []string{RoleAdmin}},
+		"reader-token": {User: "grafana", Method: "token", Roles: []string{RoleReader}, Priority: PriorityLow},
+	} {
+		id, ok := sut.AuthenticateToken(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, want, id)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("token: {user: root, roles: [superuser]}\n"), 0600))
+	_, err = LoadUsers(path)
+	assert.Contains(t, err.Error(), "unknown role 'superuser'")
+}
@@ -0,0 +1,47 @@
+package chowder
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog"
+)
+
+// Version is chowder's version, set when building with
+// `-ldflags "-X github.com/lachlanmunro/chowder/pkg.Version=v1.2.3"`, otherwise read from the build info
+var Version string
+
+// VersionResponse reports the versions of chowder and its antivirus
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Antivirus string `json:"antivirus,omitempty"`
+	Response  `json:",omitempty"`
+}
+
+func buildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// Version returns the versions of chowder and of the antivirus, with an error if the antivirus
+// did not answer
+func (p *Proxy) Version(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp := &VersionResponse{Version: buildVersion()}
+	if v, ok := p.AntiVirus.(Versioner); ok {
+		av, err := v.Version()
+		resp.Antivirus = av
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+	addLogFields(r.Context(), func(l zerolog.Context) zerolog.Context {
+		return l.Str("version", resp.Version).Str("daemon-response", resp.Antivirus).Str("error", resp.Error)
+	})
+	writeResponse(w, r, resp, http.StatusOK)
+}
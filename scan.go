@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	chowder "github.com/lachlanmunro/chowder/pkg"
+	"github.com/lachlanmunro/chowder/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+// Exit codes of chowder scan, matching clamscan
+const (
+	scanClean    = 0
+	scanInfected = 1
+	scanError    = 2
+)
+
+// scanCommand scans files and directories, returning the process exit code
+func scanCommand(args []string) int {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	server := fs.String("server", "", "Chowder server to scan through (e.g. https://chowder:3399), clamd at -antivirus is used directly if empty")
+	token := fs.String("token", os.Getenv("CHOWDER_TOKEN"), "Token to authenticate to the -server with, defaults to the CHOWDER_TOKEN environment variable")
+	caFile := fs.String("cacert", "", "PEM bundle of CAs trusted to issue the -server's certificate, the system's if empty")
+	antivirus := fs.String("antivirus", "127.0.0.1:3310", "Destination antivirus URL when no -server is given")
+	concurrency := fs.Int("concurrency", 4, "How many files to scan at once")
+	include := fs.String("include", "", "Comma separated globs of the files to scan (e.g. *.jar,*.zip), all files if empty")
+	exclude := fs.String("exclude", "", "Comma separated globs of the files and directories to skip (e.g. .git,node_modules)")
+	format := fs.String("format", "text", "Report format, one of "+strings.Join(chowder.ReportFormats, ", "))
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: chowder scan [flags] <path> ...")
+		fmt.Fprintln(fs.Output(), "Scans files and the directories under paths, exiting 0 if all are clean, 1 if any are infected and 2 if any could not be scanned")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return scanError
+	}
+	if !contains(chowder.ReportFormats, *format) {
+		fmt.Fprintf(os.Stderr, "unknown format '%v', must be one of %v\n", *format, strings.Join(chowder.ReportFormats, ", "))
+		return scanError
+	}
+	// the antivirus logs each scan at debug, which would drown out the report
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	av, err := scanBackend(ctx, *server, *token, *caFile, *antivirus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return scanError
+	}
+	if ok, msg, err := av.Ok(); !ok {
+		if err == nil {
+			err = fmt.Errorf("'%v'", msg)
+		}
+		fmt.Fprintf(os.Stderr, "antivirus is not ready: %v\n", err)
+		return scanError
+	}
+	scanner := &chowder.FileScanner{AntiVirus: av, Concurrency: *concurrency, Include: splitGlobs(*include), Exclude: splitGlobs(*exclude)}
+	start := time.Now()
+	report := chowder.NewReport(scanner.Scan(ctx, fs.Args()), time.Since(start))
+	if err = report.Write(os.Stdout, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write report: %v\n", err)
+		return scanError
+	}
+	switch {
+	case report.Summary.Infected > 0:
+		return scanInfected
+	case report.Summary.Errors > 0 || ctx.Err() != nil:
+		return scanError
+	}
+	return scanClean
+}
+
+// scanBackend returns a scanner for the chowder server, or clamd if server is empty
+func scanBackend(ctx context.Context, server, token, caFile, antivirus string) (chowder.VirusScanner, error) {
+	if server == "" {
+		return chowder.NewClamAV(antivirus), nil
+	}
+	hc := &http.Client{}
+	if caFile != "" {
+		roots, err := chowder.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		hc.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+	c, err := client.New(server, client.WithToken(token), client.WithHTTPClient(hc))
+	if err != nil {
+		return nil, err
+	}
+	return &serverScanner{ctx: ctx, client: c}, nil
+}
+
+// serverScanner scans through a chowder server
+type serverScanner struct {
+	ctx    context.Context
+	client *client.Client
+}
+
+func (s *serverScanner) Scan(stream io.Reader) (bool, string, error) {
+	result, err := s.client.Scan(s.ctx, stream, nil)
+	if err != nil {
+		return false, "", err
+	}
+	return result.Infected, result.Message, nil
+}
+
+func (s *serverScanner) Ok() (bool, string, error) {
+	if err := s.client.Ready(s.ctx); err != nil {
+		return false, "", err
+	}
+	return true, "", nil
+}
+
+func splitGlobs(globs string) []string {
+	var split []string
+	for _, g := range strings.Split(globs, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			split = append(split, g)
+		}
+	}
+	return split
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	chowder "github.com/lachlanmunro/chowder/pkg"
+)
+
+// usersCommand runs the users subcommands, returning the process exit code
+func usersCommand(args []string) int {
+	if len(args) == 0 || args[0] != "add" {
+		fmt.Fprintln(os.Stderr, "usage: chowder users add [flags] <username>")
+		return 2
+	}
+	fs := flag.NewFlagSet("users add", flag.ExitOnError)
+	hash := fs.String("hash", chowder.HashBcrypt, "Token hash algorithm, one of sha256, bcrypt, argon2id or plain")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: chowder users add [flags] <username>")
+		fmt.Fprintln(fs.Output(), "Prints the new token to stderr and the users file entry to stdout, e.g. chowder users add bob >> users.yml")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	token, err := chowder.GenerateToken()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate token: %v\n", err)
+		return 1
+	}
+	entry, err := chowder.HashToken(token, *hash)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "token for %v: %v\n", fs.Arg(0), token)
+	fmt.Printf("'%v': %v\n", entry, fs.Arg(0))
+	return 0
+}